@@ -2,7 +2,7 @@ package main
 
 /*
 
-Picocrypt v1.29
+Picocrypt v1.30
 Copyright (c) Evan Su (https://evansu.cc)
 Released under a GNU GPL v3 License
 https://github.com/HACKERALERT/Picocrypt
@@ -13,11 +13,16 @@ https://github.com/HACKERALERT/Picocrypt
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"hash"
 	"image"
@@ -26,10 +31,13 @@ import (
 	"math"
 	"math/big"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/HACKERALERT/clipboard"
@@ -59,7 +67,7 @@ var TRANSPARENT = color.RGBA{0x00, 0x00, 0x00, 0x00}
 
 // Generic variables
 var window *giu.MasterWindow
-var version = "v1.29"
+var version = "v1.30"
 var dpi float32
 var mode string
 var working bool
@@ -69,12 +77,13 @@ var scanning bool
 var modalId int
 var showPassgen bool
 var showKeyfile bool
+var showCreateKeyfile bool
 var showOverwrite bool
 var showProgress bool
 
 // Input and output files
 var inputFile string
-var inputFileOld string
+var missing badRanges // Missing chunks of a split volume being decrypted
 var outputFile string
 var onlyFiles []string
 var onlyFolders []string
@@ -87,6 +96,7 @@ var cpassword string
 var passwordStrength int
 var passwordState = giu.InputTextFlagsPassword
 var passwordStateLabel = "Show"
+var policyWarned string // Policy problem and password warned about, which starting again accepts
 
 // Password generator
 var passgenLength int32 = 32
@@ -94,13 +104,48 @@ var passgenUpper bool
 var passgenLower bool
 var passgenNums bool
 var passgenSymbols bool
+var passgenSymbolSet = symbolChars
+var passgenCustom bool
+var passgenCustomSet string
+var passgenNoAmbiguous bool
+var passgenRequireEach bool
 var passgenCopy bool
+var passgenMode int32 // Random characters or random words
+var passgenModes = []string{"Random characters", "Random words"}
+var passgenWordCount int32 = 6
+var passgenWordlist int32
+var passgenWordlists = []string{"EFF large (7776 words)", "EFF short (1296 words)"}
+var passgenSeparator = "-"
+var passgenCapitalize bool
+var passgenNumber bool
 
 // Keyfile variables
 var keyfile bool
 var keyfiles []string
 var keyfileOrdered bool
 var keyfileLabel = "None selected."
+var keyfileOnly bool                               // Derive the key from the keyfiles alone, without a password
+var managedKeyfiles = map[string]*managedKeyfile{} // Managed keyfiles among those selected
+var keyfileExpected []string                       // Fingerprints of the managed keyfiles a volume expects
+var keyfileCount int                               // Number of keyfiles a volume expects, if it records it
+var keyfileThreshold int                           // Shares a volume needs, if a key split into shares is used
+var keyfileShares int                              // Shares that key was split into
+var shareKeyfiles = map[string]*keyShare{}         // Shares among the selected keyfiles
+
+// Unlocking a managed keyfile runs in the background, so the unlocked secrets
+// and the state below are guarded, and resets are counted so that an unlock
+// started before one is thrown away
+var keyfileLock sync.Mutex
+var keyfilePassphrase string
+var keyfileStatus string // A damaged keyfile or an incorrect passphrase
+var unlocking bool       // Whether a managed keyfile is being unlocked
+var keyfileResets int
+
+// Creating a managed keyfile
+var newKeyfileLabel string
+var newKeyfilePassphrase string
+var newKeyfileConfirm string
+var newKeyfileStatus string
 
 // Comments variables
 var comments string
@@ -110,16 +155,33 @@ var commentsDisabled bool
 // Advanced options
 var paranoid bool
 var reedsolo bool
+var parityLevels = []string{"Parity: 8/128", "Parity: 16/128", "Parity: 32/128", "Parity: 64/128"}
+var paritySelected int32
+var interleave bool
 var split bool
 var splitSize string
-var splitUnits = []string{"KiB", "MiB", "GiB", "TiB", "Total"}
+var splitUnits = []string{"KiB", "MiB", "GiB", "TiB", "KB", "MB", "GB", "TB", "Total"}
 var splitSelected int32 = 1
+var splitRecovery bool
+var recoveryChunks string
 var recombine bool
+var seekable bool
+var headerBackup bool
+var detached bool
+var headerFile string
 var compress bool
 var delete bool
 var keep bool
 var kept bool
 
+// Signing variables
+var sign bool
+var signKey string
+var signKeyLabel = "No signing key selected."
+var verifySigner bool
+var signerKey string
+var signerLabel string
+
 // Status variables
 var startLabel = "Start"
 var mainStatus = "Ready."
@@ -141,6 +203,12 @@ var rs24, _ = infectious.NewFEC(24, 72)
 var rs32, _ = infectious.NewFEC(32, 96)
 var rs64, _ = infectious.NewFEC(64, 192)
 var rs128, _ = infectious.NewFEC(128, 136)
+var rs128p16, _ = infectious.NewFEC(128, 144)
+var rs128p32, _ = infectious.NewFEC(128, 160)
+var rs128p64, _ = infectious.NewFEC(128, 192)
+
+// Parity levels of the contents, selected by extended flag 3
+var rsLevels = []*infectious.FEC{rs128, rs128p16, rs128p32, rs128p64}
 var fastDecode bool
 
 // Compression variables and passthrough
@@ -174,21 +242,59 @@ func draw() {
 		giu.Custom(func() {
 			if showPassgen {
 				giu.PopupModal("Generate password:##"+strconv.Itoa(modalId)).Flags(6).Layout(
+					giu.Combo("##passgenMode", passgenModes[passgenMode], passgenModes, &passgenMode).Size(giu.Auto),
+					giu.Custom(func() {
+						if passgenMode == 1 {
+							giu.Row(
+								giu.Label("Words:"),
+								giu.SliderInt(&passgenWordCount, 3, 12).Size(giu.Auto),
+							).Build()
+							giu.Combo("##passgenWordlist", passgenWordlists[passgenWordlist], passgenWordlists, &passgenWordlist).Size(giu.Auto).Build()
+							giu.Row(
+								giu.Label("Separator:"),
+								giu.InputText(&passgenSeparator).Size(giu.Auto),
+							).Build()
+							giu.Checkbox("Capitalize words", &passgenCapitalize).Build()
+							giu.Checkbox("Add a number", &passgenNumber).Build()
+						} else {
+							giu.Row(
+								giu.Label("Length:"),
+								giu.SliderInt(&passgenLength, 4, 64).Size(giu.Auto),
+							).Build()
+							giu.Checkbox("Uppercase", &passgenUpper).Build()
+							giu.Checkbox("Lowercase", &passgenLower).Build()
+							giu.Checkbox("Numbers", &passgenNums).Build()
+							giu.Row(
+								giu.Checkbox("Symbols:", &passgenSymbols),
+								giu.InputText(&passgenSymbolSet).Size(giu.Auto).OnChange(func() {
+									passgenSymbols = passgenSymbolSet != ""
+								}),
+							).Build()
+							giu.Row(
+								giu.Checkbox("Custom:", &passgenCustom),
+								giu.InputText(&passgenCustomSet).Size(giu.Auto).OnChange(func() {
+									passgenCustom = passgenCustomSet != ""
+								}),
+							).Build()
+							giu.Tooltip("Add your own characters to choose from.").Build()
+							giu.Checkbox("Exclude ambiguous characters", &passgenNoAmbiguous).Build()
+							giu.Tooltip("Leave out characters that are easy to confuse, like 0 and O or l and 1.").Build()
+							giu.Checkbox("Require every character type", &passgenRequireEach).Build()
+							giu.Tooltip("Use every selected type of character at least once.").Build()
+						}
+					}),
 					giu.Row(
-						giu.Label("Length:"),
-						giu.SliderInt(&passgenLength, 4, 64).Size(giu.Auto),
+						giu.Checkbox("Copy to clipboard", &passgenCopy),
+						giu.Combo("##clipboardTimeout", clipboardTimeouts[clipboardTimeout], clipboardTimeouts, &clipboardTimeout).Size(giu.Auto),
 					),
-					giu.Checkbox("Uppercase", &passgenUpper),
-					giu.Checkbox("Lowercase", &passgenLower),
-					giu.Checkbox("Numbers", &passgenNums),
-					giu.Checkbox("Symbols", &passgenSymbols),
-					giu.Checkbox("Copy to clipboard", &passgenCopy),
+					giu.Tooltip("Clear the clipboard after this long, if it still holds the password."),
+					giu.Label(passgenLabel()),
 					giu.Row(
 						giu.Button("Cancel").Size(100, 0).OnClick(func() {
 							giu.CloseCurrentPopup()
 							showPassgen = false
 						}),
-						giu.Style().SetDisabled(!(passgenUpper || passgenLower || passgenNums || passgenSymbols)).To(
+						giu.Style().SetDisabled(passgenMode == 0 && passgenSettings().check() != nil).To(
 							giu.Button("Generate").Size(100, 0).OnClick(func() {
 								password = genPassword()
 								cpassword = password
@@ -211,21 +317,96 @@ func draw() {
 						if mode != "decrypt" {
 							giu.Checkbox("Require correct order", &keyfileOrdered).Build()
 							giu.Tooltip("Decryption will require the correct keyfile order.").Build()
-						} else if keyfileOrdered {
-							giu.Label("Correct order is required.").Build()
+							giu.Checkbox("Keyfiles only, no password", &keyfileOnly).OnChange(func() {
+								password = ""
+								cpassword = ""
+							}).Build()
+							giu.Tooltip("Derive the key from the keyfiles alone, without a password.").Build()
+						} else {
+							if keyfileOrdered {
+								giu.Label("Correct order is required.").Build()
+							}
+							if keyfileOnly {
+								giu.Label("Keyfiles only, no password needed.").Build()
+							}
+						}
+					}),
+					giu.Custom(func() {
+						if len(keyfileExpected) > 0 {
+							giu.Label("Expects " + strings.Join(keyfileExpected, ", ") + ".").Build()
 						}
 					}),
 					giu.Separator(),
 					giu.Custom(func() {
+						keyfileLock.Lock()
+						defer keyfileLock.Unlock()
+						locked := ""
 						for _, i := range keyfiles {
-							giu.Label(filepath.Base(i)).Build()
+							if s := shareKeyfiles[i]; s != nil {
+								giu.Label(fmt.Sprintf("%s (share %d of %d, %d needed)", filepath.Base(i), s.Index, s.Count, s.Threshold)).Build()
+								continue
+							}
+							k := managedKeyfiles[i]
+							if k == nil {
+								giu.Label(filepath.Base(i)).Build()
+								continue
+							}
+							label := fmt.Sprintf("%s (%s)", k.Label, k.fingerprint())
+							if _, ok := unlockedKeyfiles[i]; !ok {
+								label += " (locked)"
+								if locked == "" {
+									locked = i
+								}
+							}
+							giu.Label(label).Build()
+							giu.Tooltip(filepath.Base(i) + ", created " + k.Created).Build()
+						}
+
+						// Unlock one managed keyfile at a time, in the background since
+						// Argon2 takes a while
+						if locked != "" {
+							giu.Row(
+								giu.InputText(&keyfilePassphrase).Flags(giu.InputTextFlagsPassword).Size(120),
+								giu.Tooltip("Passphrase of "+managedKeyfiles[locked].Label+"."),
+								giu.Style().SetDisabled(unlocking).To(
+									giu.Button("Unlock").Size(88, 0).OnClick(func() {
+										unlocking = true
+										keyfileStatus = "Unlocking..."
+										k, passphrase := managedKeyfiles[locked], keyfilePassphrase
+										resets := keyfileResets
+										go func() {
+											secret, err := k.unlock(passphrase)
+											keyfileLock.Lock()
+											defer keyfileLock.Unlock()
+											if resets != keyfileResets {
+												return
+											}
+											if err != nil {
+												keyfileStatus = "Incorrect passphrase."
+											} else {
+												unlockedKeyfiles[locked] = secret
+												keyfilePassphrase = ""
+												keyfileStatus = ""
+											}
+											unlocking = false
+											giu.Update()
+										}()
+									}),
+								),
+							).Build()
+						}
+						if keyfileStatus != "" {
+							giu.Label(keyfileStatus).Build()
 						}
 					}),
 					giu.Row(
 						giu.Button("Clear").Size(100, 0).OnClick(func() {
 							keyfiles = nil
+							keyfileLock.Lock()
+							resetUnlocking()
+							keyfileLock.Unlock()
 							if keyfile {
-								keyfileLabel = "Keyfiles required."
+								keyfileLabel = keyfilesRequired()
 							} else {
 								keyfileLabel = "None selected."
 							}
@@ -244,6 +425,80 @@ func draw() {
 				giu.Update()
 			}
 
+			if showCreateKeyfile {
+				giu.PopupModal("Create keyfile:##"+strconv.Itoa(modalId)).Flags(70).Layout(
+					giu.Row(
+						giu.Label("Label:"),
+						giu.InputText(&newKeyfileLabel).Size(giu.Auto),
+					),
+					giu.Row(
+						giu.Label("Passphrase:"),
+						giu.InputText(&newKeyfilePassphrase).Flags(giu.InputTextFlagsPassword).Size(giu.Auto),
+					),
+					giu.Tooltip("Leave empty for a plain keyfile of random data."),
+					giu.Row(
+						giu.Label("Confirm:"),
+						giu.InputText(&newKeyfileConfirm).Flags(giu.InputTextFlagsPassword).Size(giu.Auto),
+					),
+					giu.Custom(func() {
+						if newKeyfileStatus != "" {
+							giu.Label(newKeyfileStatus).Build()
+						}
+					}),
+					giu.Row(
+						giu.Button("Cancel").Size(100, 0).OnClick(func() {
+							giu.CloseCurrentPopup()
+							showCreateKeyfile = false
+						}),
+						giu.Button("Create").Size(100, 0).OnClick(func() {
+							if newKeyfilePassphrase != newKeyfileConfirm {
+								newKeyfileStatus = "Passphrases don't match."
+								return
+							}
+							f := dialog.File().Title("Choose where to save the keyfile.")
+							f.SetStartDir(func() string {
+								if len(onlyFiles) > 0 {
+									return filepath.Dir(onlyFiles[0])
+								}
+								return filepath.Dir(onlyFolders[0])
+							}())
+							f.SetInitFilename("Keyfile")
+							file, err := f.Save()
+							if file == "" || err != nil {
+								return
+							}
+
+							// Without a passphrase, save random data as before
+							if newKeyfilePassphrase == "" {
+								data := make([]byte, MiB)
+								rand.Read(data)
+								err = os.WriteFile(file, data, 0600)
+							} else {
+								var k *managedKeyfile
+								var secret []byte
+								k, secret, err = createManagedKeyfile(file, newKeyfileLabel, newKeyfilePassphrase)
+								if err == nil {
+									managedKeyfiles[file] = k
+									keyfileLock.Lock()
+									unlockedKeyfiles[file] = secret
+									keyfileLock.Unlock()
+								}
+							}
+							if err != nil {
+								newKeyfileStatus = "Can't write the keyfile."
+								return
+							}
+							newKeyfilePassphrase = ""
+							newKeyfileConfirm = ""
+							giu.CloseCurrentPopup()
+							showCreateKeyfile = false
+						}),
+					),
+				).Build()
+				giu.OpenPopup("Create keyfile:##" + strconv.Itoa(modalId))
+				giu.Update()
+			}
+
 			if showOverwrite {
 				giu.PopupModal("Warning:##"+strconv.Itoa(modalId)).Flags(6).Layout(
 					giu.Label("Output already exists. Overwrite?"),
@@ -314,7 +569,13 @@ func draw() {
 
 		giu.Separator(),
 		giu.Style().SetDisabled((len(allFiles) == 0 && len(onlyFiles) == 0) || scanning).To(
-			giu.Label("Password:"),
+			giu.Custom(func() {
+				if keyfileOnly {
+					giu.Label("Password: not used, keyfiles only.").Build()
+				} else {
+					giu.Label("Password:").Build()
+				}
+			}),
 			giu.Row(
 				giu.Button(passwordStateLabel).Size(54, 0).OnClick(func() {
 					if passwordState == giu.InputTextFlagsPassword {
@@ -336,10 +597,10 @@ func draw() {
 				giu.Tooltip("Clear the password entries."),
 
 				giu.Button("Copy").Size(54, 0).OnClick(func() {
-					clipboard.WriteAll(password)
+					copyPassword(password)
 					giu.Update()
 				}),
-				giu.Tooltip("Copy the password into your clipboard."),
+				giu.Tooltip("Copy the password into your clipboard ("+strings.ToLower(clipboardTimeouts[clipboardTimeout])+")."),
 
 				giu.Button("Paste").Size(54, 0).OnClick(func() {
 					tmp, _ := clipboard.ReadAll()
@@ -362,10 +623,12 @@ func draw() {
 				giu.Tooltip("Generate a cryptographically secure password."),
 			),
 			giu.Row(
-				giu.InputText(&password).Flags(passwordState).Size(302/dpi).OnChange(func() {
-					passwordStrength = zxcvbn.PasswordStrength(password, nil).Score
-					giu.Update()
-				}),
+				giu.Style().SetDisabled(keyfileOnly).To(
+					giu.InputText(&password).Flags(passwordState).Size(302/dpi).OnChange(func() {
+						passwordStrength = zxcvbn.PasswordStrength(password, nil).Score
+						giu.Update()
+					}),
+				),
 				giu.Custom(func() {
 					c := giu.GetCanvas()
 					p := giu.GetCursorScreenPos()
@@ -423,26 +686,12 @@ func draw() {
 
 					giu.Style().SetDisabled(mode == "decrypt").To(
 						giu.Button("Create").Size(54, 0).OnClick(func() {
-							f := dialog.File().Title("Choose where to save the keyfile.")
-							f.SetStartDir(func() string {
-								if len(onlyFiles) > 0 {
-									return filepath.Dir(onlyFiles[0])
-								}
-								return filepath.Dir(onlyFolders[0])
-							}())
-							f.SetInitFilename("Keyfile")
-							file, err := f.Save()
-							if file == "" || err != nil {
-								return
-							}
-
-							fout, _ := os.Create(file)
-							data := make([]byte, MiB)
-							rand.Read(data)
-							fout.Write(data)
-							fout.Close()
+							showCreateKeyfile = true
+							newKeyfileStatus = ""
+							modalId++
+							giu.Update()
 						}),
-						giu.Tooltip("Generate a cryptographically secure keyfile."),
+						giu.Tooltip("Generate a keyfile, optionally protected by a passphrase."),
 					),
 					giu.Style().SetDisabled(true).To(
 						giu.InputText(&keyfileLabel).Size(giu.Auto),
@@ -452,7 +701,7 @@ func draw() {
 		),
 
 		giu.Separator(),
-		giu.Style().SetDisabled(mode != "decrypt" && ((len(keyfiles) == 0 && password == "") || (password != cpassword))).To(
+		giu.Style().SetDisabled(mode != "decrypt" && !credentialsGiven()).To(
 			giu.Style().SetDisabled(mode == "decrypt" && (comments == "" || comments == "Comments are corrupted.")).To(
 				giu.Label(commentsLabel),
 				giu.InputText(&comments).Size(giu.Auto).Flags(func() giu.InputTextFlags {
@@ -463,7 +712,7 @@ func draw() {
 				}()),
 			),
 		),
-		giu.Style().SetDisabled((len(keyfiles) == 0 && password == "") || (mode == "encrypt" && password != cpassword)).To(
+		giu.Style().SetDisabled((mode == "decrypt" && password == "" && len(keyfiles) == 0) || (mode == "encrypt" && !credentialsGiven())).To(
 			giu.Label("Advanced:"),
 			giu.Custom(func() {
 				if mode != "decrypt" {
@@ -491,17 +740,119 @@ func draw() {
 						giu.Tooltip("Delete the input files after encryption."),
 					).Build()
 
+					giu.Row(
+						giu.Style().SetDisabled(!reedsolo).To(
+							giu.Checkbox("Interleave", &interleave),
+						),
+						giu.Tooltip("Spread Reed-Solomon blocks out to survive bad sectors and burst errors."),
+						giu.Dummy(-170, 0),
+						giu.Style().SetDisabled(!reedsolo).To(
+							giu.Combo("##parity", parityLevels[paritySelected], parityLevels, &paritySelected).Size(164),
+						),
+						giu.Tooltip("Choose how many Reed-Solomon parity bytes protect every 128 bytes."),
+					).Build()
+
 					giu.Row(
 						giu.Checkbox("Split into chunks:", &split),
 						giu.Tooltip("Split the output file into smaller chunks."),
 						giu.Dummy(-170, 0),
-						giu.InputText(&splitSize).Size(86/dpi).Flags(2).OnChange(func() {
+						giu.InputText(&splitSize).Size(86/dpi).OnChange(func() {
 							split = splitSize != ""
 						}),
-						giu.Tooltip("Choose the chunk size."),
+						giu.Tooltip("Choose the chunk size, like 650, 4.7GB, or DVD."),
 						giu.Combo("##splitter", splitUnits[splitSelected], splitUnits, &splitSelected).Size(68),
 						giu.Tooltip("Choose the chunk units."),
 					).Build()
+
+					giu.Row(
+						giu.Style().SetDisabled(!split).To(
+							giu.Checkbox("Recovery chunks:", &splitRecovery),
+						),
+						giu.Tooltip("Add chunks that can replace any missing or damaged chunks."),
+						giu.Dummy(-170, 0),
+						giu.Style().SetDisabled(!split).To(
+							giu.InputText(&recoveryChunks).Size(86/dpi).Flags(2).OnChange(func() {
+								splitRecovery = recoveryChunks != ""
+							}),
+						),
+						giu.Tooltip("Choose how many chunks can be lost."),
+					).Build()
+
+					giu.Row(
+						giu.Checkbox("Back up header", &headerBackup),
+						giu.Tooltip("Save a copy of the header to a .pcvh file."),
+						giu.Dummy(-170, 0),
+						giu.Checkbox("Detach header", &detached),
+						giu.Tooltip("Save the header only to a .pcvh file, leaving random data in its place."),
+					).Build()
+
+					giu.Row(
+						giu.Checkbox("Random access", &seekable),
+						giu.Tooltip("Allow decrypting parts of the volume without reading all of it."),
+					).Build()
+
+					giu.Row(
+						giu.Style().SetDisabled(signKey == "").To(
+							giu.Checkbox("Sign volume", &sign),
+						),
+						giu.Tooltip(signKeyLabel),
+						giu.Dummy(-170, 0),
+						giu.Button("Select").Size(78, 0).OnClick(func() {
+							f := dialog.File().Title("Choose your signing key.")
+							f.SetStartDir(func() string {
+								if len(onlyFiles) > 0 {
+									return filepath.Dir(onlyFiles[0])
+								}
+								return filepath.Dir(onlyFolders[0])
+							}())
+							file, err := f.Load()
+							if file == "" || err != nil {
+								return
+							}
+
+							key, err := loadSignKey(file)
+							if err != nil {
+								mainStatus = "Invalid signing key."
+								mainStatusColor = RED
+								return
+							}
+							signKey = file
+							signKeyLabel = "Signing as " + fingerprint(key.Public().(ed25519.PublicKey)) + "."
+							sign = true
+							giu.Update()
+						}),
+						giu.Tooltip("Choose an existing signing key."),
+						giu.Button("Create").Size(78, 0).OnClick(func() {
+							f := dialog.File().Title("Choose where to save the signing key.")
+							f.SetStartDir(func() string {
+								if len(onlyFiles) > 0 {
+									return filepath.Dir(onlyFiles[0])
+								}
+								return filepath.Dir(onlyFolders[0])
+							}())
+							f.SetInitFilename("Signing key")
+							file, err := f.Save()
+							if file == "" || err != nil {
+								return
+							}
+
+							// Save the private key, and the public key for verifiers
+							pub, key, _ := ed25519.GenerateKey(rand.Reader)
+							err = os.WriteFile(file, key, 0600)
+							if err == nil {
+								err = os.WriteFile(file+".pub", pub, 0644)
+							}
+							if err != nil {
+								accessDenied("Write")
+								return
+							}
+							signKey = file
+							signKeyLabel = "Signing as " + fingerprint(pub) + "."
+							sign = true
+							giu.Update()
+						}),
+						giu.Tooltip("Generate a new signing key and its public key (.pub)."),
+					).Build()
 				} else {
 					giu.Row(
 						giu.Checkbox("Force decrypt", &keep),
@@ -510,6 +861,39 @@ func draw() {
 						giu.Checkbox("Delete volume", &delete),
 						giu.Tooltip("Delete the volume after a successful decryption."),
 					).Build()
+
+					giu.Row(
+						giu.Style().SetDisabled(signerKey == "").To(
+							giu.Checkbox("Verify signer", &verifySigner),
+						),
+						giu.Tooltip("Require the volume to be signed by the selected key."),
+						giu.Dummy(-170, 0),
+						giu.Button("Select public key").Size(160, 0).OnClick(func() {
+							f := dialog.File().Title("Choose the signer's public key.")
+							f.SetStartDir(filepath.Dir(inputFile))
+							file, err := f.Load()
+							if file == "" || err != nil {
+								return
+							}
+
+							if _, err := loadSignerKey(file); err != nil {
+								mainStatus = "Invalid public key."
+								mainStatusColor = RED
+								return
+							}
+							signerKey = file
+							verifySigner = true
+							giu.Update()
+						}),
+						giu.Tooltip("Choose the public key (.pub) of the expected signer."),
+					).Build()
+
+					if signerLabel != "" {
+						giu.Label(signerLabel).Build()
+					}
+					if len(keyfileExpected) > 0 {
+						giu.Label("Expects keyfile " + strings.Join(keyfileExpected, ", ") + ".").Build()
+					}
 				}
 			}),
 
@@ -580,17 +964,51 @@ func draw() {
 			giu.Separator(),
 			giu.Dummy(0, 0),
 			giu.Button(startLabel).Size(giu.Auto, 34).OnClick(func() {
-				if keyfile && keyfiles == nil {
+				if (keyfile || keyfileOnly) && keyfiles == nil {
 					mainStatus = "Please select your keyfiles."
 					mainStatusColor = RED
 					return
 				}
-				tmp, err := strconv.Atoi(splitSize)
-				if split && (splitSize == "" || tmp <= 0 || err != nil) {
+				if mode == "encrypt" && password == "" && !keyfileOnly {
+					mainStatus = "Please enter a password, or use keyfiles only."
+					mainStatusColor = RED
+					return
+				}
+				keyfileLock.Lock()
+				for _, i := range keyfiles {
+					if _, ok := unlockedKeyfiles[i]; managedKeyfiles[i] != nil && !ok {
+						keyfileLock.Unlock()
+						mainStatus = "Please unlock your keyfiles."
+						mainStatusColor = RED
+						return
+					}
+				}
+				keyfileLock.Unlock()
+				if mode == "decrypt" && verifySigner && signerLabel == "" {
+					mainStatus = "The volume is not signed."
+					mainStatusColor = RED
+					return
+				}
+				chunks, total, err := parseSplitSize(splitSize, splitUnits[splitSelected])
+				if split && err != nil {
 					mainStatus = "Invalid split size."
 					mainStatusColor = RED
 					return
 				}
+				tmp, err := strconv.Atoi(recoveryChunks)
+				if split && splitRecovery && (tmp <= 0 || err != nil) {
+					mainStatus = "Invalid number of recovery chunks."
+					mainStatusColor = RED
+					return
+				}
+				if split && splitRecovery && total && chunks+int64(tmp) > maxRecoverySet {
+					mainStatus = "Too many chunks for recovery chunks (at most 256 together)."
+					mainStatusColor = RED
+					return
+				}
+				if !checkPolicy() {
+					return
+				}
 				_, err = os.Stat(outputFile)
 				if err == nil {
 					showOverwrite = true
@@ -623,6 +1041,9 @@ func draw() {
 
 func onDrop(names []string) {
 	if showKeyfile {
+		keyfileLock.Lock()
+		defer keyfileLock.Unlock()
+		resetUnlocking()
 		keyfiles = append(keyfiles, names...)
 
 		// Remove duplicate keyfiles and make sure they're accessible
@@ -640,7 +1061,16 @@ func onDrop(names []string) {
 				fin.Close()
 			}
 			if !duplicate && !stat.IsDir() && err == nil {
+				if k, err := readManagedKeyfile(i); err != nil {
+					keyfileStatus = filepath.Base(i) + " is a damaged keyfile."
+					continue
+				} else if k != nil {
+					managedKeyfiles[i] = k
+				}
 				tmp = append(tmp, i)
+				if s, _ := readShare(i); s != nil {
+					shareKeyfiles[i] = s
+				}
 			}
 		}
 		keyfiles = tmp
@@ -689,10 +1119,30 @@ func onDrop(names []string) {
 			}
 			isSplit := strings.Contains(names[0], ".pcv.") && endsNum
 
+			// If a detached header was dropped, find the volume it belongs to
+			if strings.HasSuffix(names[0], ".pcvh") {
+				headerFile = names[0]
+				names[0] = strings.TrimSuffix(names[0], "h")
+				if _, err := os.Stat(names[0]); err != nil {
+					if _, err := os.Stat(names[0] + ".0"); err != nil {
+						resetUI()
+						mainStatus = "Can't find the volume for this header."
+						mainStatusColor = RED
+						return
+					}
+					names[0] += ".0"
+					isSplit = true
+				}
+				stat, _ = os.Stat(names[0])
+			}
+
 			// Decide if encrypting or decrypting
 			if strings.HasSuffix(names[0], ".pcv") || isSplit {
 				mode = "decrypt"
 				inputLabel = "Volume for decryption."
+				if headerFile != "" {
+					inputLabel = "Volume with detached header."
+				}
 				startLabel = "Decrypt"
 				commentsLabel = "Comments (read-only):"
 				commentsDisabled = true
@@ -719,74 +1169,104 @@ func onDrop(names []string) {
 					outputFile = names[0][:len(names[0])-4]
 				}
 
-				// Open the input file in read-only mode
-				var fin *os.File
-				var err error
+				// Open the input file (or its detached header) in read-only mode
+				path := names[0]
 				if isSplit {
-					fin, err = os.Open(names[0] + ".0")
-				} else {
-					fin, err = os.Open(names[0])
+					path += ".0"
 				}
-				if err != nil {
+				if headerFile != "" {
+					path = headerFile
+				}
+				var h *header
+				fin, err := os.Open(path)
+				if err == nil {
+					h, err = readHeader(fin)
+					fin.Close()
+				} else if isSplit && headerFile == "" {
+					// The first chunk may be missing, but the recovery chunks can rebuild it
+					head, herr := splitHead(inputFile)
+					if herr != nil {
+						resetUI()
+						if _, serr := os.Stat(path); os.IsNotExist(serr) {
+							mainStatus = "Chunk 0 is missing."
+							mainStatusColor = RED
+						} else {
+							accessDenied("Read")
+						}
+						return
+					}
+					h, err = readHeader(bytes.NewReader(head))
+				} else {
 					resetUI()
 					accessDenied("Read")
 					return
 				}
 
+				// A volume with a detached header looks like random data, so
+				// look for the header next to it (also used if the header is damaged)
+				valid, _ := regexp.Match(`^v\d\.\d{2}`, []byte(h.version))
+				if (!valid || err != nil) && headerFile == "" {
+					if tmp, herr := os.Open(names[0] + "h"); herr == nil {
+						headerFile = names[0] + "h"
+						inputLabel = "Volume with detached header."
+						h, err = readHeader(tmp)
+						tmp.Close()
+						valid, _ = regexp.Match(`^v\d\.\d{2}`, []byte(h.version))
+					}
+				}
+
 				// Use regex to test if the input is a valid Picocrypt volume
-				tmp := make([]byte, 15)
-				fin.Read(tmp)
-				tmp, err = rsDecode(rs5, tmp)
-				if valid, _ := regexp.Match(`^v\d\.\d{2}`, tmp); !valid || err != nil {
+				if !valid {
 					resetUI()
 					mainStatus = "This doesn't seem like a Picocrypt volume."
 					mainStatusColor = RED
-					fin.Close()
 					return
 				}
 
-				// Read comments from file and check for corruption
-				tmp = make([]byte, 15)
-				fin.Read(tmp)
-				tmp, err = rsDecode(rs5, tmp)
-				if err == nil {
-					commentsLength, _ := strconv.Atoi(string(tmp))
-					tmp = make([]byte, commentsLength*3)
-					fin.Read(tmp)
-					comments = ""
-					for i := 0; i < commentsLength*3; i += 3 {
-						t, err := rsDecode(rs1, tmp[i:i+3])
-						if err != nil {
-							comments = "Comments are corrupted."
-							break
-						}
-						comments += string(t)
-					}
-				} else {
+				// The flags can't be shown, and force decrypt can't work, without
+				// knowing which layout the header has
+				if err == errVersionDamaged {
+					resetUI()
+					mainStatus = "The volume header is damaged."
+					mainStatusColor = RED
+					return
+				}
+
+				// Show the comments and check for corruption
+				comments = h.comments
+				if h.commentsDamaged {
 					comments = "Comments are corrupted."
 				}
 
-				// Read flags from file and check for corruption
-				flags := make([]byte, 15)
-				fin.Read(flags)
-				fin.Close()
-				flags, err = rsDecode(rs5, flags)
+				// Show who signed the volume
+				if h.signed() {
+					if verifyHeader(h) {
+						signerLabel = "Signed by " + fingerprint(h.signer) + "."
+					} else {
+						signerLabel = "The volume signature is invalid."
+					}
+				}
+
+				// Warn about corruption, but still allow a force decrypt
 				if err != nil {
 					mainStatus = "The volume header is damaged."
 					mainStatusColor = RED
-					return
 				}
 
 				// Update UI and variables according to flags
-				if flags[1] == 1 {
+				if h.flags[1] == 1 {
 					keyfile = true
-					keyfileLabel = "Keyfiles required."
+					keyfileCount = h.keyfileCheckCount()
+					keyfileThreshold, keyfileShares = h.shares()
+					keyfileLabel = keyfilesRequired()
 				} else {
 					keyfileLabel = "Not applicable."
 				}
-				if flags[2] == 1 {
+				keyfileOnly = h.keyfileOnly()
+				if h.flags[2] == 1 {
 					keyfileOrdered = true
 				}
+				keyfileExpected = expectedKeyfiles(h)
 			} else { // One file was dropped for encryption
 				mode = "encrypt"
 				inputLabel = "1 file."
@@ -866,6 +1346,40 @@ func onDrop(names []string) {
 	}()
 }
 
+// Hold the password of a new volume to the policy, warning once about a
+// password that doesn't meet it unless the policy rejects such passwords.
+// Returns whether to go ahead.
+func checkPolicy() bool {
+	if mode != "encrypt" {
+		return true
+	}
+	if policyErr != nil {
+		mainStatus = "The password policy can't be read."
+		mainStatusColor = RED
+		return false
+	}
+	problem := policy.checkKeyfileOnly()
+	if !keyfileOnly {
+		var err error
+		if problem, err = policy.check(password); err != nil {
+			mainStatus = "The password policy can't be read."
+			mainStatusColor = RED
+			return false
+		}
+	}
+	if problem != "" && (policy.Reject || policyWarned != problem+"\n"+password) {
+		mainStatus = strings.ToUpper(problem[:1]) + problem[1:] + "."
+		mainStatusColor = RED
+		if !policy.Reject {
+			mainStatus += fmt.Sprintf(" Click %s again to go ahead.", startLabel)
+			mainStatusColor = YELLOW
+			policyWarned = problem + "\n" + password
+		}
+		return false
+	}
+	return true
+}
+
 func work() {
 	popupStatus = "Starting..."
 	mainStatus = "Working..."
@@ -884,7 +1398,31 @@ func work() {
 	var keyfileKey []byte              // The SHA3-256 hashes of keyfiles
 	var keyfileHash = make([]byte, 32) // The SHA3-256 of 'keyfileKey'
 	var keyfileHashRef []byte          // Same as 'keyfileHash', but used for comparison
+	var keyfileSums [][]byte           // The SHA3-256 of every keyfile, for the keyfile checks
 	var authTag []byte                 // 64-byte authentication tag (BLAKE2b or HMAC-SHA3)
+	var h *header                      // Header of the volume being processed
+
+	// Load the signing keys before doing any work
+	var signPriv ed25519.PrivateKey
+	var trustedSigner ed25519.PublicKey
+	if mode == "encrypt" && sign {
+		var err error
+		signPriv, err = loadSignKey(signKey)
+		if err != nil {
+			mainStatus = "Invalid signing key."
+			mainStatusColor = RED
+			return
+		}
+	}
+	if mode == "decrypt" && verifySigner {
+		var err error
+		trustedSigner, err = loadSignerKey(signerKey)
+		if err != nil {
+			mainStatus = "Invalid public key."
+			mainStatusColor = RED
+			return
+		}
+	}
 
 	// Combine/compress all files into a .zip file if needed
 	if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
@@ -978,129 +1516,78 @@ func work() {
 		file.Close()
 	}
 
-	// Recombine a split file if necessary
-	if recombine {
-		totalFiles := 0
-		totalBytes := int64(0)
-		done := 0
+	// Check the chunks of a split volume against the manifest and rebuild
+	// missing or damaged ones from the recovery chunks, if any. If that's not
+	// possible, the problem is reported once the header shows whether
+	// Reed-Solomon can help.
+	var chunkSet *splitSet
+	chunkError, chunkHeader := "", false
+	damagedError := "The input file is damaged or modified."
 
-		// Find out the number of splitted chunks
-		for {
-			stat, err := os.Stat(fmt.Sprintf("%s.%d", inputFile, totalFiles))
-			if err != nil {
-				break
+	// Why the signature couldn't be verified, if the volume was kept anyway
+	signatureError := ""
+	if recombine {
+		if set, err := readSplitSet(inputFile); err == nil {
+			popupStatus = "Checking chunks..."
+			giu.Update()
+			if bad := set.check(); len(bad) > 0 {
+				popupStatus = "Rebuilding chunks..."
+				giu.Update()
+				if set.rebuild(bad) != nil {
+					chunkError, chunkHeader = set.problem(bad)
+				}
 			}
-			totalFiles++
-			totalBytes += stat.Size()
+			chunkSet = set
 		}
+	}
 
-		// Create a .pcv to combine chunks into
-		fout, err := os.Create(outputFile + ".pcv")
-		if err != nil {
-			accessDenied("Write")
-			return
+	canCancel = false
+	progress = 0
+	progressInfo = ""
+	giu.Update()
+
+	// Open input file in read-only mode, reading a split volume across its chunks
+	var fin volumeFile
+	var volumeSize int64
+	var err error
+	if recombine {
+		var chunks *splitFile
+		chunks, err = openSplitFile(inputFile, chunkSet)
+		if err == nil {
+			fin, volumeSize = chunks, chunks.Size()
+			missing = chunks.missing()
 		}
+	} else {
+		var stat os.FileInfo
+		if stat, err = os.Stat(inputFile); err == nil {
+			fin, err = os.Open(inputFile)
+			volumeSize = stat.Size()
+		}
+	}
+	if err != nil {
+		resetUI()
+		accessDenied("Read")
+		return
+	}
 
-		// Merge all chunks into one file
-		startTime := time.Now()
-		for i := 0; i < totalFiles; i++ {
-			fin, _ := os.Open(fmt.Sprintf("%s.%d", inputFile, i))
-			for {
-				if !working {
-					cancel()
-					fin.Close()
-					fout.Close()
-					os.Remove(outputFile + ".pcv")
-					return
-				}
-
-				// Copy from the chunk into the .pcv
-				data := make([]byte, MiB)
-				read, err := fin.Read(data)
-				if err != nil {
-					break
-				}
-				data = data[:read]
-				_, err = fout.Write(data)
-				done += read
-
-				if err != nil {
-					insufficientSpace()
-					fin.Close()
-					fout.Close()
-					os.Remove(outputFile + ".pcv")
-					return
-				}
-
-				// Update the stats
-				progress, speed, eta = statify(int64(done), totalBytes, startTime)
-				progressInfo = fmt.Sprintf("%d/%d", i+1, totalFiles)
-				popupStatus = fmt.Sprintf("Recombining at %.2f MiB/s (ETA: %s)", speed, eta)
-				giu.Update()
-			}
-			fin.Close()
-		}
-		fout.Close()
-		inputFileOld = inputFile
-		inputFile = outputFile + ".pcv"
-	}
-
-	canCancel = false
-	progress = 0
-	progressInfo = ""
-	giu.Update()
-
-	// Subtract the header size from the total size if decrypting
-	stat, _ := os.Stat(inputFile)
-	total := stat.Size()
-	if mode == "decrypt" {
-		total -= 789
-	}
-
-	// Open input file in read-only mode
-	fin, err := os.Open(inputFile)
-	if err != nil {
-		resetUI()
-		accessDenied("Read")
-		return
-	}
+	// Get the total size (the header size is subtracted later if decrypting)
+	total := volumeSize
 
 	// Set up output file
-	var fout *os.File
+	var fout volumeFile
 
 	// If encrypting, generate values and write to file
 	if mode == "encrypt" {
 		popupStatus = "Generating values..."
 		giu.Update()
 
-		// Create the output file
-		var err error
-		fout, err = os.Create(outputFile)
-		if err != nil {
-			fin.Close()
-			accessDenied("Write")
-			return
-		}
-
 		// Set up cryptographic values
 		salt = make([]byte, 16)
 		hkdfSalt = make([]byte, 32)
 		serpentSalt = make([]byte, 16)
 		nonce = make([]byte, 24)
 
-		// Write the program version to file
-		fout.Write(rsEncode(rs5, []byte(version)))
-
-		// Encode and write the comment length to file
-		commentsLength := []byte(fmt.Sprintf("%05d", len(comments)))
-		fout.Write(rsEncode(rs5, commentsLength))
-
-		// Encode the comment and write to file
-		for _, i := range []byte(comments) {
-			fout.Write(rsEncode(rs1, []byte{i}))
-		}
-
-		// Configure flags and write to file
+		// Configure flags
 		flags := make([]byte, 5)
 		if paranoid { // Paranoid mode selected
 			flags[0] = 1
@@ -1114,10 +1601,31 @@ func work() {
 		if reedsolo { // Full Reed-Solomon encoding is selected
 			flags[3] = 1
 		}
-		if total%int64(MiB) >= int64(MiB)-128 { // Reed-Solomon internals
+		stored := total
+		if seekable {
+			stored += 64 * segmentCount(total)
+		}
+		if stored%int64(MiB) >= int64(MiB)-128 { // Reed-Solomon internals
 			flags[4] = 1
 		}
-		fout.Write(rsEncode(rs5, flags))
+		extFlags := make([]byte, 16)
+		if sign { // The header will be signed
+			extFlags[0] = 1
+		}
+		if seekable { // Segments can be decrypted on their own
+			extFlags[1] = 1
+		}
+		if reedsolo { // Reed-Solomon parity level
+			extFlags[3] = byte(paritySelected)
+		}
+		if reedsolo && interleave { // Reed-Solomon blocks are interleaved
+			extFlags[4] = 1
+		}
+		if keyfileOnly { // The key comes from the keyfiles alone
+			extFlags[9] = 1
+		}
+		keyfileIDs := managedKeyfileIDs(keyfiles)
+		extFlags[5] = byte(len(keyfileIDs)) // Managed keyfiles to expect
 
 		// Fill values with Go's CSPRNG
 		rand.Read(salt)
@@ -1125,110 +1633,178 @@ func work() {
 		rand.Read(serpentSalt)
 		rand.Read(nonce)
 
-		// Encode values with Reed-Solomon and write to file
-		fout.Write(rsEncode(rs16, salt))
-		fout.Write(rsEncode(rs32, hkdfSalt))
-		fout.Write(rsEncode(rs16, serpentSalt))
-		fout.Write(rsEncode(rs24, nonce))
+		// Write the header with placeholders for values computed later
+		h = &header{
+			version:     version,
+			comments:    comments,
+			flags:       flags,
+			salt:        salt,
+			hkdfSalt:    hkdfSalt,
+			serpentSalt: serpentSalt,
+			nonce:       nonce,
+			keyHash:     make([]byte, 64),
+			keyfileHash: make([]byte, 32),
+			authTag:     make([]byte, 64),
+			extFlags:    extFlags,
+			keyfileIDs:  keyfileIDs,
+		}
+		h.prepareKeyfileChecks(keyfiles)
+		if sign {
+			h.signer = signPriv.Public().(ed25519.PublicKey)
+			h.signature = make([]byte, ed25519.SignatureSize)
+		}
+
+		// Create the output file, or its first chunk if splitting
+		var err error
+		if split {
+			var sizes []int64
+			sizes, err = splitSizes(encodedSize(h, total))
+			status := "Invalid split size."
+
+			// Chunks of a given size are only counted now, so check that
+			// recovery chunks can be added before encrypting anything
+			if count, _ := strconv.Atoi(recoveryChunks); err == nil && splitRecovery && len(sizes)+count > maxRecoverySet {
+				err = errors.New("too many chunks")
+				status = "Too many chunks for recovery chunks (at most 256 together)."
+			}
+			if err != nil {
+				fin.Close()
+				if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
+					os.Remove(inputFile)
+				}
+				mainStatus = status
+				mainStatusColor = RED
+				return
+			}
+			fout, err = createSplitFile(outputFile, sizes)
+		} else {
+			fout, err = os.Create(outputFile)
+		}
+		if err != nil {
+			fin.Close()
+			if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
+				os.Remove(inputFile)
+			}
+			accessDenied("Write")
+			return
+		}
 
-		// Write placeholders for future use
-		fout.Write(make([]byte, 192)) // Hash of encryption key
-		fout.Write(make([]byte, 96))  // Hash of keyfile key
-		fout.Write(make([]byte, 192)) // BLAKE2b/HMAC-SHA3 tag
+		if detached {
+			// Fill the header's space with random data, the header goes into a .pcvh
+			tmp := make([]byte, h.size())
+			rand.Read(tmp)
+			fout.Write(tmp)
+		} else {
+			writeHeader(fout, h)
+		}
 	} else { // Decrypting, read values from file and decode
 		popupStatus = "Reading values..."
 		giu.Update()
 
-		// Stores any Reed-Solomon decoding errors
-		errs := make([]error, 10)
-
-		version := make([]byte, 15)
-		fin.Read(version)
-		_, errs[0] = rsDecode(rs5, version)
-
-		tmp := make([]byte, 15)
-		fin.Read(tmp)
-		tmp, errs[1] = rsDecode(rs5, tmp)
-		commentsLength, _ := strconv.Atoi(string(tmp))
-		fin.Read(make([]byte, commentsLength*3))
-		total -= int64(commentsLength) * 3
-
-		flags := make([]byte, 15)
-		fin.Read(flags)
-		flags, errs[2] = rsDecode(rs5, flags)
-		paranoid = flags[0] == 1
-		reedsolo = flags[3] == 1
-		padded = flags[4] == 1
-
-		salt = make([]byte, 48)
-		fin.Read(salt)
-		salt, errs[3] = rsDecode(rs16, salt)
-
-		hkdfSalt = make([]byte, 96)
-		fin.Read(hkdfSalt)
-		hkdfSalt, errs[4] = rsDecode(rs32, hkdfSalt)
-
-		serpentSalt = make([]byte, 48)
-		fin.Read(serpentSalt)
-		serpentSalt, errs[5] = rsDecode(rs16, serpentSalt)
-
-		nonce = make([]byte, 72)
-		fin.Read(nonce)
-		nonce, errs[6] = rsDecode(rs24, nonce)
+		var err error
+		if headerFile != "" {
+			// Read the detached header and skip its space in the volume
+			var hin *os.File
+			hin, err = os.Open(headerFile)
+			if err != nil {
+				fin.Close()
+				accessDenied("Read")
+				return
+			}
+			h, err = readHeader(hin)
+			hin.Close()
+		} else {
+			h, err = readHeader(fin)
+		}
+		if err == errVersionDamaged {
+			fin.Close()
+			mainStatus = "The volume header is damaged."
+			mainStatusColor = RED
+			return
+		}
+		if headerFile != "" {
+			fin.Seek(h.size(), 0)
+		}
+		total -= h.size()
+		paranoid = h.flags[0] == 1
+		reedsolo = h.flags[3] == 1
+		padded = h.flags[4] == 1
+		seekable = h.extended() && h.extFlags[1] == 1
+		keyfileOnly = h.keyfileOnly()
+		if h.payloadCode() == nil {
+			if reedsolo && err == nil {
+				err = errors.New("unknown Reed-Solomon parity level")
+			}
+		} else if h.extended() {
+			paritySelected = int32(h.extFlags[3])
+		}
+		interleave = h.interleaved()
+		salt = h.salt
+		hkdfSalt = h.hkdfSalt
+		serpentSalt = h.serpentSalt
+		nonce = h.nonce
+		keyHashRef = h.keyHash
+		keyfileHashRef = h.keyfileHash
+		authTag = h.authTag
 
-		keyHashRef = make([]byte, 192)
-		fin.Read(keyHashRef)
-		keyHashRef, errs[7] = rsDecode(rs64, keyHashRef)
+		// If there was an issue during decoding, the header is corrupted
+		if err != nil {
+			if keep { // If the user chooses to force decrypt
+				kept = true
+			} else {
+				mainStatus = "The volume header is damaged."
+				mainStatusColor = RED
+				fin.Close()
+				return
+			}
+		}
 
-		keyfileHashRef = make([]byte, 96)
-		fin.Read(keyfileHashRef)
-		keyfileHashRef, errs[8] = rsDecode(rs32, keyfileHashRef)
+		// Without Reed-Solomon, missing or damaged chunks can't be corrected,
+		// unless the damage is only to the header in the first chunk
+		if chunkError != "" && !reedsolo && !chunkHeader {
+			if keep {
+				kept = true
+			} else {
+				mainStatus = chunkError
+				mainStatusColor = RED
+				fin.Close()
+				os.Remove(inputFile)
+				return
+			}
+		}
 
-		authTag = make([]byte, 192)
-		fin.Read(authTag)
-		authTag, errs[9] = rsDecode(rs64, authTag)
+		// If decryption fails, say which chunks are to blame
+		if chunkError != "" {
+			damagedError = chunkError
+		}
 
-		// If there was an issue during decoding, the header is corrupted
-		for _, err := range errs {
-			if err != nil {
-				if keep { // If the user chooses to force decrypt
-					kept = true
-				} else {
-					mainStatus = "The volume header is damaged."
-					mainStatusColor = RED
-					fin.Close()
-					if recombine {
-						os.Remove(inputFile)
-					}
-					return
-				}
+		// Check the signature before spending time on key derivation
+		if h.signed() && !verifyHeader(h) {
+			signatureError = "The volume signature is invalid."
+		} else if verifySigner && !h.signed() {
+			signatureError = "The volume is not signed."
+		} else if verifySigner && !bytes.Equal(h.signer, trustedSigner) {
+			signatureError = "The volume was signed by an unknown key."
+		}
+		if signatureError != "" {
+			// Force decrypt doesn't override a signer that was asked for
+			if keep && !verifySigner {
+				kept = true
+			} else {
+				mainStatus = signatureError
+				mainStatusColor = RED
+				fin.Close()
+				return
 			}
 		}
 	}
 
-	popupStatus = "Deriving key..."
-	giu.Update()
-
-	// Derive encryption keys and subkeys
+	// Derive encryption keys and subkeys, skipping Argon2 if there's no password
 	var key []byte
-	if paranoid {
-		key = argon2.IDKey(
-			[]byte(password),
-			salt,
-			8,     // 8 passes
-			1<<20, // 1 GiB memory
-			8,     // 8 threads
-			32,    // 32-byte output key
-		)
-	} else {
-		key = argon2.IDKey(
-			[]byte(password),
-			salt,
-			4,
-			1<<20,
-			4,
-			32,
-		)
+	if !keyfileOnly {
+		popupStatus = "Deriving key..."
+		giu.Update()
+		key = deriveKey(password, salt, paranoid)
 	}
 
 	// If keyfiles are being used
@@ -1236,44 +1812,35 @@ func work() {
 		popupStatus = "Reading keyfiles..."
 		giu.Update()
 
-		if keyfileOrdered { // If order matters, hash progressively
-			var tmp = sha3.New256()
-			for _, path := range keyfiles {
-				fin, _ := os.Open(path)
-				stat, _ := os.Stat(path)
-				data := make([]byte, stat.Size())
-				fin.Read(data)
-				fin.Close()
-				tmp.Write(data)
+		var err error
+		keyfileKey, keyfileHash, keyfileSums, err = hashKeyfiles(keyfiles, keyfileOrdered)
+		if err != nil {
+			fin.Close()
+			if mode == "encrypt" {
+				fout.Close()
+				removeOutput()
 			}
-			keyfileKey = tmp.Sum(nil)
-
-			tmp = sha3.New256()
-			tmp.Write(keyfileKey)
-			keyfileHash = tmp.Sum(nil)
-		} else { // If order doesn't matter, hash individually and combine
-			for _, path := range keyfiles {
-				fin, _ := os.Open(path)
-				stat, _ := os.Stat(path)
-				data := make([]byte, stat.Size())
-				fin.Read(data)
-				fin.Close()
-				tmp := sha3.New256()
-				tmp.Write(data)
-				sum := tmp.Sum(nil)
-				if keyfileKey == nil {
-					keyfileKey = sum
-				} else {
-					for i, j := range sum {
-						keyfileKey[i] ^= j
-					}
-				}
+			if mode == "encrypt" && (len(allFiles) > 1 || len(onlyFolders) > 0 || compress) {
+				os.Remove(inputFile)
 			}
-
-			// Store a hash of the keyfile key for comparison
-			tmp := sha3.New256()
-			tmp.Write(keyfileKey)
-			keyfileHash = tmp.Sum(nil)
+			var kerr *keyfileError
+			var serr *shareError
+			if errors.As(err, &serr) {
+				mainStatus = fmt.Sprintf("Not enough shares (%d of %d needed).", serr.given, serr.threshold)
+				mainStatusColor = RED
+			} else if errors.As(err, &kerr) && kerr.err == errKeyfileLocked {
+				mainStatus = fmt.Sprintf("Please unlock keyfile %s.", filepath.Base(kerr.path))
+				mainStatusColor = RED
+			} else if kerr != nil {
+				mainStatus = fmt.Sprintf("Can't read keyfile %s.", filepath.Base(kerr.path))
+				mainStatusColor = RED
+			} else {
+				accessDenied("Keyfile read")
+			}
+			return
+		}
+		if keyfileOnly {
+			key = keyfileOnlyKey(keyfileKey, salt)
 		}
 	}
 
@@ -1299,8 +1866,10 @@ func work() {
 			if keep {
 				kept = true
 			} else {
-				if !keyCorrect {
+				if !keyCorrect && !keyfileOnly {
 					mainStatus = "The provided password is incorrect."
+				} else if problem := keyfileProblem(h, keyfileSums, keyfileOrdered); problem != "" {
+					mainStatus = strings.ToUpper(problem[:1]) + problem[1:] + "."
 				} else {
 					if keyfileOrdered {
 						mainStatus = "Incorrect keyfiles or order."
@@ -1310,9 +1879,6 @@ func work() {
 				}
 				mainStatusColor = RED
 				fin.Close()
-				if recombine {
-					os.Remove(inputFile)
-				}
 				return
 			}
 		}
@@ -1326,8 +1892,9 @@ func work() {
 		}
 	}
 
-	if len(keyfiles) > 0 || keyfile {
-		// XOR the encryption key with the keyfile key
+	// XOR the encryption key with the keyfile key, unless it was derived from
+	// the keyfile key alone
+	if (len(keyfiles) > 0 || keyfile) && !keyfileOnly {
 		tmp := key
 		key = make([]byte, 32)
 		for i := range key {
@@ -1355,30 +1922,114 @@ func work() {
 	s, _ := serpent.NewCipher(serpentKey)
 	serpent := cipher.NewCTR(s, serpentSalt)
 
+	// The Reed-Solomon code of the contents
+	rs := rsLevels[paritySelected]
+
+	// Seekable volumes encrypt each segment separately
+	var segments *segmentCipher
+	if seekable {
+		segments = newSegmentCipher(key, h)
+	}
+
 	canCancel = true
 	startTime := time.Now()
-	for {
+
+	// Seekable volumes are decrypted and verified one segment at a time
+	var reader *volumeReader
+	if mode == "decrypt" && seekable {
+		reader, err = newVolumeReader(fin, volumeSize, h, key, missing)
+		if err != nil {
+			broken(fin, fout, "The input file is irrecoverably damaged.")
+			return
+		}
+		for i := int64(0); i < reader.segments; i++ {
+			// If the user cancels the process, stop and clean up
+			if !working {
+				cancel()
+				fin.Close()
+				fout.Close()
+				removeOutput()
+				return
+			}
+
+			data, tag, err := reader.read(i)
+			if err != nil {
+				if keep && data != nil {
+					kept = true
+				} else {
+					broken(fin, fout, damagedError)
+					return
+				}
+			}
+			if !reader.appends {
+				mac.Write(tag)
+			}
+
+			_, err = fout.Write(data)
+			if err != nil {
+				insufficientSpace()
+				fin.Close()
+				fout.Close()
+				removeOutput()
+				return
+			}
+
+			// Update stats
+			if reedsolo {
+				done += MiB / 128 * rs.Total()
+			} else {
+				done += MiB
+			}
+			progress, speed, eta = statify(int64(done), total, startTime)
+			progressInfo = fmt.Sprintf("%.2f%%", progress*100)
+			popupStatus = fmt.Sprintf("Decrypting at %.2f MiB/s (ETA: %s)", speed, eta)
+			giu.Update()
+		}
+
+		// Appendable volumes are authenticated by the last segment of every
+		// generation (see appendGeneration)
+		if reader.appends {
+			if tags, err := reader.generationTags(h); err == nil {
+				writeGenerationTags(mac, h, tags)
+			}
+		}
+	}
+
+	// Everything else is processed in 1 MiB chunks. When decrypting, sectors
+	// that fail to read are zeroed and remembered like the missing chunks of a
+	// split volume, the same way as on the command line.
+	var payload io.Reader = fin
+	var disk *erasureReader
+	if mode == "decrypt" {
+		start, _ := fin.Seek(0, io.SeekCurrent)
+		disk = &erasureReader{r: fin, bad: missing}
+		payload = io.NewSectionReader(disk, start, volumeSize-start)
+	}
+	segment := 0
+	for reader == nil {
 		// If the user cancels the process, stop and clean up
 		if !working {
 			cancel()
 			fin.Close()
 			fout.Close()
-			if recombine || len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
+			if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
 				os.Remove(inputFile)
 			}
-			os.Remove(outputFile)
+			removeOutput()
 			return
 		}
 
 		// Read in data from the file
 		var src []byte
 		if mode == "decrypt" && reedsolo {
-			src = make([]byte, MiB/128*136)
+			src = make([]byte, MiB/128*rs.Total())
+		} else if seekable {
+			src = make([]byte, segmentSize)
 		} else {
 			src = make([]byte, MiB)
 		}
-		size, err := fin.Read(src)
-		if err != nil {
+		size, err := payload.Read(src)
+		if err != nil && !(seekable && segment == 0) { // A seekable volume has at least one segment
 			break
 		}
 		src = src[:size]
@@ -1386,43 +2037,71 @@ func work() {
 
 		// Do the actual encryption
 		if mode == "encrypt" {
-			if paranoid {
-				serpent.XORKeyStream(dst, src)
-				copy(src, dst)
-			}
+			if seekable {
+				// The volume's tag is computed over the tags of the segments
+				final := int64(segment*segmentSize+size) >= total
+				dst = segments.seal(uint64(segment), final, src)
+				mac.Write(dst[len(dst)-64:])
+				segment++
+			} else {
+				if paranoid {
+					serpent.XORKeyStream(dst, src)
+					copy(src, dst)
+				}
 
-			chacha.XORKeyStream(dst, src)
-			mac.Write(dst)
+				chacha.XORKeyStream(dst, src)
+				mac.Write(dst)
+			}
 
 			if reedsolo {
-				copy(src, dst)
+				src = dst
 				dst = nil
 				// If a full MiB is available
 				if len(src) == MiB {
 					// Encode every chunk
 					for i := 0; i < MiB; i += 128 {
-						dst = append(dst, rsEncode(rs128, src[i:i+128])...)
+						dst = append(dst, rsEncode(rs, src[i:i+128])...)
 					}
 				} else {
 					// Encode the full chunks
 					chunks := math.Floor(float64(len(src)) / 128)
 					for i := 0; float64(i) < chunks; i++ {
-						dst = append(dst, rsEncode(rs128, src[i*128:(i+1)*128])...)
+						dst = append(dst, rsEncode(rs, src[i*128:(i+1)*128])...)
 					}
 
 					// Pad and encode the final partial chunk
-					dst = append(dst, rsEncode(rs128, pad(src[int(chunks*128):]))...)
+					dst = append(dst, rsEncode(rs, pad(src[int(chunks*128):]))...)
+				}
+				if interleave {
+					dst = interleaveBlocks(dst, rs.Total())
 				}
 			}
 		} else { // Decryption
 			if reedsolo {
 				copy(dst, src)
 				src = nil
+				if interleave {
+					dst = deinterleaveBlocks(dst, rs.Total())
+				}
+
+				// Missing chunks of a split volume and sectors that failed to
+				// read are corrected as erasures
+				erased := disk.erased(h.size()+int64(done), len(dst))
+				if erased != nil && interleave {
+					erased = deinterleaveBlocks(erased, rs.Total())
+				}
+				mask := func(i, j int) []byte {
+					if erased == nil {
+						return nil
+					}
+					return erased[i:j]
+				}
+
 				// If a complete 1 MiB block is available
-				if len(dst) == MiB/128*136 {
+				if len(dst) == MiB/128*rs.Total() {
 					// Decode every chunk
-					for i := 0; i < MiB/128*136; i += 136 {
-						tmp, err := rsDecode(rs128, dst[i:i+136])
+					for i := 0; i < MiB/128*rs.Total(); i += rs.Total() {
+						tmp, err := rsDecode(rs, dst[i:i+rs.Total()], mask(i, i+rs.Total()))
 						if err != nil {
 							if keep {
 								kept = true
@@ -1431,12 +2110,12 @@ func work() {
 								return
 							}
 						}
-						if i == MiB/128*136-136 && done+MiB/128*136 >= int(total) && padded {
+						if i == MiB/128*rs.Total()-rs.Total() && done+MiB/128*rs.Total() >= int(total) && padded {
 							tmp = unpad(tmp)
 						}
 						src = append(src, tmp...)
 
-						if !fastDecode && i%17408 == 0 {
+						if !fastDecode && i%(128*rs.Total()) == 0 {
 							progress, speed, eta = statify(int64(done+i), total, startTime)
 							progressInfo = fmt.Sprintf("%.2f%%", progress*100)
 							popupStatus = fmt.Sprintf("Repairing at %.2f MiB/s (ETA: %s)", speed, eta)
@@ -1445,9 +2124,9 @@ func work() {
 					}
 				} else {
 					// Decode the full chunks
-					chunks := len(dst)/136 - 1
+					chunks := len(dst)/rs.Total() - 1
 					for i := 0; i < chunks; i++ {
-						tmp, err := rsDecode(rs128, dst[i*136:(i+1)*136])
+						tmp, err := rsDecode(rs, dst[i*rs.Total():(i+1)*rs.Total()], mask(i*rs.Total(), (i+1)*rs.Total()))
 						if err != nil {
 							if keep {
 								kept = true
@@ -1459,7 +2138,7 @@ func work() {
 						src = append(src, tmp...)
 
 						if !fastDecode && i%128 == 0 {
-							progress, speed, eta = statify(int64(done+i*136), total, startTime)
+							progress, speed, eta = statify(int64(done+i*rs.Total()), total, startTime)
 							progressInfo = fmt.Sprintf("%.2f%%", progress*100)
 							popupStatus = fmt.Sprintf("Repairing at %.2f MiB/s (ETA: %s)", speed, eta)
 							giu.Update()
@@ -1467,7 +2146,7 @@ func work() {
 					}
 
 					// Unpad and decode the final partial chunk
-					tmp, err := rsDecode(rs128, dst[int(chunks)*136:])
+					tmp, err := rsDecode(rs, dst[int(chunks)*rs.Total():], mask(int(chunks)*rs.Total(), len(dst)))
 					if err != nil {
 						if keep {
 							kept = true
@@ -1495,16 +2174,16 @@ func work() {
 			insufficientSpace()
 			fin.Close()
 			fout.Close()
-			if recombine || len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
+			if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
 				os.Remove(inputFile)
 			}
-			os.Remove(outputFile)
+			removeOutput()
 			return
 		}
 
 		// Update stats
 		if mode == "decrypt" && reedsolo {
-			done += MiB / 128 * 136
+			done += MiB / 128 * rs.Total()
 		} else {
 			done += MiB
 		}
@@ -1546,17 +2225,44 @@ func work() {
 		giu.Update()
 
 		// Seek back to header and write important values
-		fout.Seek(int64(309+len(comments)*3), 0)
-		fout.Write(rsEncode(rs64, keyHash))
-		fout.Write(rsEncode(rs32, keyfileHash))
-		fout.Write(rsEncode(rs64, mac.Sum(nil)))
+		h.keyHash = keyHash
+		h.keyfileHash = keyfileHash
+		h.recordKeyfileChecks(keyfileSums)
+		h.authTag = mac.Sum(nil)
+		if sign {
+			h.signature = ed25519.Sign(signPriv, h.signedData())
+		}
+		if !detached {
+			fout.Seek(0, 0)
+			writeHeader(fout, h)
+		}
+
+		// Save the header to a separate file if needed
+		if detached || headerBackup {
+			hout, err := os.Create(outputFile + "h")
+			if err == nil {
+				err = writeHeader(hout, h)
+				hout.Close()
+			}
+			if err != nil {
+				fin.Close()
+				fout.Close()
+				if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
+					os.Remove(inputFile)
+				}
+				removeOutput()
+				os.Remove(outputFile + "h")
+				accessDenied("Write")
+				return
+			}
+		}
 	} else {
 		popupStatus = "Comparing values..."
 		giu.Update()
 
 		// Validate the authenticity of decrypted data
 		if subtle.ConstantTimeCompare(mac.Sum(nil), authTag) == 0 {
-			if reedsolo && fastDecode {
+			if reedsolo && fastDecode && !seekable {
 				fastDecode = false
 				fin.Close()
 				fout.Close()
@@ -1566,7 +2272,7 @@ func work() {
 			if keep {
 				kept = true
 			} else {
-				broken(fin, fout, "The input file is damaged or modified.")
+				broken(fin, fout, damagedError)
 				return
 			}
 		}
@@ -1575,124 +2281,30 @@ func work() {
 	fin.Close()
 	fout.Close()
 
-	// Split the file into chunks
-	if split {
-		var splitted []string
-		stat, _ := os.Stat(outputFile)
-		size := stat.Size()
-		finishedFiles := 0
-		finishedBytes := 0
-		chunkSize, _ := strconv.Atoi(splitSize)
-
-		// Calculate chunk size
-		if splitSelected == 0 {
-			chunkSize *= KiB
-		} else if splitSelected == 1 {
-			chunkSize *= MiB
-		} else if splitSelected == 2 {
-			chunkSize *= GiB
-		} else if splitSelected == 3 {
-			chunkSize *= TiB
-		} else {
-			chunkSize = int(math.Ceil(float64(size) / float64(chunkSize)))
+	// Describe the chunks in a manifest and add recovery chunks if needed
+	warning := ""
+	if mode == "encrypt" && split {
+		set, err := fout.(*splitFile).splitSet()
+		if err == nil && splitRecovery {
+			popupStatus = "Adding recovery chunks..."
+			giu.Update()
+			count, _ := strconv.Atoi(recoveryChunks)
+			if err := set.writeRecoveryChunks(count); err != nil {
+				warning = "Recovery chunks couldn't be added."
+			}
+		}
+		if err == nil {
+			err = set.writeManifest()
+		}
+		if err != nil {
+			warning = "The chunk manifest couldn't be written."
 		}
+	}
 
-		// Get the number of required chunks
-		chunks := int(math.Ceil(float64(size) / float64(chunkSize)))
-		progressInfo = fmt.Sprintf("%d/%d", finishedFiles+1, chunks)
-		giu.Update()
-		fin, _ := os.Open(outputFile)
-
-		startTime := time.Now()
-		for i := 0; i < chunks; i++ {
-			// Make the chunk
-			fout, _ := os.Create(fmt.Sprintf("%s.%d", outputFile, i))
-			done := 0
-
-			// Copy data into the chunk
-			for {
-				data := make([]byte, MiB)
-				for done+len(data) > chunkSize {
-					data = make([]byte, int(math.Ceil(float64(len(data))/2)))
-				}
-
-				read, err := fin.Read(data)
-				if err != nil {
-					break
-				}
-				if !working {
-					cancel()
-					fin.Close()
-					fout.Close()
-					if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-						os.Remove(inputFile)
-					}
-					os.Remove(outputFile)
-
-					// If user cancels, remove the unfinished files
-					for _, j := range splitted {
-						os.Remove(j)
-					}
-					os.Remove(fmt.Sprintf("%s.%d", outputFile, i))
-
-					return
-				}
-
-				data = data[:read]
-				_, err = fout.Write(data)
-				if err != nil {
-					insufficientSpace()
-					fin.Close()
-					fout.Close()
-					if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-						os.Remove(inputFile)
-					}
-					os.Remove(outputFile)
-
-					// If user cancels, remove the unfinished files
-					for _, j := range splitted {
-						os.Remove(j)
-					}
-					os.Remove(fmt.Sprintf("%s.%d", outputFile, i))
-
-					return
-				}
-				done += read
-				if done >= chunkSize {
-					break
-				}
-
-				// Update stats
-				finishedBytes += read
-				progress, speed, eta = statify(int64(finishedBytes), int64(size), startTime)
-				popupStatus = fmt.Sprintf("Splitting at %.2f MiB/s (ETA: %s)", speed, eta)
-				giu.Update()
-			}
-			fout.Close()
-
-			// Update stats
-			finishedFiles++
-			if finishedFiles == chunks {
-				finishedFiles--
-			}
-			splitted = append(splitted, fmt.Sprintf("%s.%d", outputFile, i))
-			progressInfo = fmt.Sprintf("%d/%d", finishedFiles+1, chunks)
-			giu.Update()
-		}
-
-		fin.Close()
-		os.Remove(outputFile)
-	}
-
-	canCancel = false
-	progress = 0
-	progressInfo = ""
-	giu.Update()
-
-	// Remove the temporary file used to combine a splitted volume
-	if recombine {
-		os.Remove(inputFile)
-	}
+	canCancel = false
+	progress = 0
+	progressInfo = ""
+	giu.Update()
 
 	// Delete the temporary .zip used to encrypt files
 	if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
@@ -1706,18 +2318,13 @@ func work() {
 
 		if mode == "decrypt" {
 			if recombine { // Remove each chunk
-				i := 0
-				for {
-					_, err := os.Stat(fmt.Sprintf("%s.%d", inputFileOld, i))
-					if err != nil {
-						break
-					}
-					os.Remove(fmt.Sprintf("%s.%d", inputFileOld, i))
-					i++
-				}
+				removeChunks(inputFile)
 			} else {
 				os.Remove(inputFile)
 			}
+			if headerFile != "" {
+				os.Remove(headerFile)
+			}
 		} else {
 			for _, i := range onlyFiles {
 				os.Remove(i)
@@ -1734,9 +2341,15 @@ func work() {
 	kept = oldKept
 
 	// If the user chose to keep a corrupted/modified file, let them know
-	if kept {
+	if kept && signatureError != "" {
+		mainStatus = signatureError + " Please be careful."
+		mainStatusColor = YELLOW
+	} else if kept {
 		mainStatus = "The input file was modified. Please be careful."
 		mainStatusColor = YELLOW
+	} else if warning != "" {
+		mainStatus = warning
+		mainStatusColor = YELLOW
 	} else {
 		mainStatus = "Completed."
 		mainStatusColor = GREEN
@@ -1756,17 +2369,23 @@ func insufficientSpace() {
 }
 
 // If corruption is detected during decryption
-func broken(fin *os.File, fout *os.File, message string) {
+func broken(fin volumeFile, fout volumeFile, message string) {
 	fin.Close()
 	fout.Close()
 	mainStatus = message
 	mainStatusColor = RED
 
 	// Clean up files since decryption failed
-	if recombine {
-		os.Remove(inputFile)
+	removeOutput()
+}
+
+// Remove an unfinished output file, or all chunks of a split one
+func removeOutput() {
+	if mode == "encrypt" && split {
+		removeChunks(outputFile)
+	} else {
+		os.Remove(outputFile)
 	}
-	os.Remove(outputFile)
 }
 
 // Stop working
@@ -1775,13 +2394,45 @@ func cancel() {
 	mainStatusColor = WHITE
 }
 
+// Whether a password or keyfiles are given for encrypting, so the options
+// after them can be set
+func credentialsGiven() bool {
+	if keyfileOnly {
+		return len(keyfiles) > 0
+	}
+	return password != "" && password == cpassword
+}
+
+// The keyfile status of a volume that needs keyfiles
+func keyfilesRequired() string {
+	if keyfileThreshold > 0 {
+		return fmt.Sprintf("%d of %d shares required.", keyfileThreshold, keyfileShares)
+	}
+	switch keyfileCount {
+	case 0:
+		return "Keyfiles required."
+	case 1:
+		return "1 keyfile required."
+	}
+	return fmt.Sprintf("%d keyfiles required.", keyfileCount)
+}
+
+// Drop an unlock in progress along with its passphrase and status; the caller
+// holds keyfileLock
+func resetUnlocking() {
+	keyfileResets++
+	unlocking = false
+	keyfilePassphrase = ""
+	keyfileStatus = ""
+}
+
 // Reset the UI to a clean state with nothing selected or checked
 func resetUI() {
 	imgui.ClearActiveID()
 	mode = ""
 
 	inputFile = ""
-	inputFileOld = ""
+	missing = nil
 	outputFile = ""
 	onlyFiles = nil
 	onlyFolders = nil
@@ -1792,18 +2443,41 @@ func resetUI() {
 	cpassword = ""
 	passwordState = giu.InputTextFlagsPassword
 	passwordStateLabel = "Show"
+	policyWarned = ""
 
 	passgenLength = 32
 	passgenUpper = true
 	passgenLower = true
 	passgenNums = true
 	passgenSymbols = true
+	passgenSymbolSet = symbolChars
+	passgenCustom = false
+	passgenCustomSet = ""
+	passgenNoAmbiguous = false
+	passgenRequireEach = false
 	passgenCopy = true
+	passgenMode = 0
+	passgenWordCount = 6
+	passgenWordlist = 0
+	passgenSeparator = "-"
+	passgenCapitalize = false
+	passgenNumber = false
 
 	keyfile = false
 	keyfiles = nil
 	keyfileOrdered = false
 	keyfileLabel = "None selected."
+	keyfileOnly = false
+	managedKeyfiles = map[string]*managedKeyfile{}
+	keyfileLock.Lock()
+	unlockedKeyfiles = map[string][]byte{}
+	resetUnlocking()
+	keyfileLock.Unlock()
+	keyfileExpected = nil
+	keyfileCount = 0
+	keyfileThreshold = 0
+	keyfileShares = 0
+	shareKeyfiles = map[string]*keyShare{}
 
 	comments = ""
 	commentsLabel = "Comments:"
@@ -1811,15 +2485,30 @@ func resetUI() {
 
 	paranoid = false
 	reedsolo = false
+	paritySelected = 0
+	interleave = false
 	split = false
 	splitSize = ""
 	splitSelected = 1
+	splitRecovery = false
+	recoveryChunks = ""
 	recombine = false
+	seekable = false
+	headerBackup = false
+	detached = false
+	headerFile = ""
 	compress = false
 	delete = false
 	keep = false
 	kept = false
 
+	sign = false
+	signKey = ""
+	signKeyLabel = "No signing key selected."
+	verifySigner = false
+	signerKey = ""
+	signerLabel = ""
+
 	startLabel = "Start"
 	mainStatus = "Ready."
 	mainStatusColor = WHITE
@@ -1830,123 +2519,2652 @@ func resetUI() {
 	giu.Update()
 }
 
-// Reed-Solomon encoder
-func rsEncode(rs *infectious.FEC, data []byte) []byte {
-	res := make([]byte, rs.Total())
-	rs.Encode(data, func(s infectious.Share) {
-		res[s.Number] = s.Data[0]
-	})
-	return res
+// The decoded values of a volume header (see Internals.md for the layout)
+type header struct {
+	version         string
+	comments        string
+	commentsDamaged bool
+	flags           []byte   // Paranoid, keyfiles, keyfile order, Reed-Solomon, padding
+	salt            []byte   // Argon2 salt, 16 bytes
+	hkdfSalt        []byte   // HKDF-SHA3 salt, 32 bytes
+	serpentSalt     []byte   // Serpent salt, 16 bytes
+	nonce           []byte   // 24-byte XChaCha20 nonce
+	keyHash         []byte   // SHA3-512 hash of encryption key
+	keyfileHash     []byte   // SHA3-256 of 'keyfileKey'
+	authTag         []byte   // 64-byte authentication tag (BLAKE2b or HMAC-SHA3)
+	extFlags        []byte   // Extended flags (v1.30+), 16 bytes
+	generations     []byte   // Segment and generation counts of an appendable volume
+	keyfileIDs      [][]byte // IDs of the managed keyfiles used, 16 bytes each
+	keyfileSalt     []byte   // Salt of the keyfile checks, 16 bytes
+	keyfileChecks   [][]byte // Salted fingerprints of the keyfiles, 5 bytes each
+	signer          []byte   // Ed25519 public key of the signer
+	signature       []byte   // Ed25519 signature of the header
 }
 
-// Reed-Solomon decoder
-func rsDecode(rs *infectious.FEC, data []byte) ([]byte, error) {
-	// If fast decode, just return the first 128 bytes
-	if rs.Total() == 136 && fastDecode {
-		return data[:128], nil
+// Volumes created before v1.30 don't have the extended header fields
+func (h *header) extended() bool {
+	return h.version >= "v1.30"
+}
+
+// Whether the volume is signed with an Ed25519 key
+func (h *header) signed() bool {
+	return h.extended() && h.extFlags[0] == 1
+}
+
+// Whether new generations can be appended to the volume
+func (h *header) appendable() bool {
+	return h.extended() && h.extFlags[2] == 1
+}
+
+// The Reed-Solomon code of the contents, or nil if the parity level is unknown
+func (h *header) payloadCode() *infectious.FEC {
+	if !h.extended() {
+		return rs128
+	}
+	if int(h.extFlags[3]) >= len(rsLevels) {
+		return nil
+	}
+	return rsLevels[h.extFlags[3]]
+}
+
+// Whether the Reed-Solomon blocks of the contents are interleaved
+func (h *header) interleaved() bool {
+	return h.extended() && h.extFlags[4] == 1
+}
+
+// Whether the key comes from the keyfiles alone, without a password
+func (h *header) keyfileOnly() bool {
+	return h.extended() && h.extFlags[9] == 1
+}
+
+// Shares needed to rebuild a key split into shares, and how many there are
+func (h *header) shares() (int, int) {
+	if !h.extended() {
+		return 0, 0
 	}
+	return int(h.extFlags[7]), int(h.extFlags[8])
+}
 
-	tmp := make([]infectious.Share, rs.Total())
-	for i := 0; i < rs.Total(); i++ {
-		tmp[i].Number = i
-		tmp[i].Data = append(tmp[i].Data, data[i])
+// Number of managed keyfile IDs recorded in the header
+func (h *header) managedCount() int {
+	if !h.extended() {
+		return 0
 	}
-	res, err := rs.Decode(nil, tmp)
+	return int(h.extFlags[5])
+}
 
-	// Force decode the data but return the error as well
+// Number of keyfile checks recorded in the header
+func (h *header) keyfileCheckCount() int {
+	if !h.extended() {
+		return 0
+	}
+	return int(h.extFlags[6])
+}
+
+// Size of the encoded header in bytes
+func (h *header) size() int64 {
+	size := int64(789 + len(h.comments)*3)
+	if h.extended() {
+		size += 48
+	}
+	if h.appendable() {
+		size += 48
+	}
+	size += int64(48 * h.managedCount())
+	if n := h.keyfileCheckCount(); n > 0 {
+		size += int64(48 + 15*n)
+	}
+	if h.signed() {
+		size += 96 + 192
+	}
+	return size
+}
+
+// The data covered by the signature (every decoded value except the signature)
+func (h *header) signedData() []byte {
+	var data []byte
+	data = append(data, h.version...)
+	data = append(data, fmt.Sprintf("%05d", len(h.comments))...)
+	data = append(data, h.comments...)
+	data = append(data, h.flags...)
+	data = append(data, h.salt...)
+	data = append(data, h.hkdfSalt...)
+	data = append(data, h.serpentSalt...)
+	data = append(data, h.nonce...)
+	data = append(data, h.keyHash...)
+	data = append(data, h.keyfileHash...)
+	data = append(data, h.authTag...)
+	data = append(data, h.extFlags...)
+	data = append(data, h.generations...)
+	for _, i := range h.keyfileIDs {
+		data = append(data, i...)
+	}
+	data = append(data, h.keyfileSalt...)
+	for _, i := range h.keyfileChecks {
+		data = append(data, i...)
+	}
+	data = append(data, h.signer...)
+	return data
+}
+
+// Encode the header with Reed-Solomon and write it
+func writeHeader(fout io.Writer, h *header) error {
+	var data []byte
+	data = append(data, rsEncode(rs5, []byte(h.version))...)
+	data = append(data, rsEncode(rs5, []byte(fmt.Sprintf("%05d", len(h.comments))))...)
+	for _, i := range []byte(h.comments) {
+		data = append(data, rsEncode(rs1, []byte{i})...)
+	}
+	data = append(data, rsEncode(rs5, h.flags)...)
+	data = append(data, rsEncode(rs16, h.salt)...)
+	data = append(data, rsEncode(rs32, h.hkdfSalt)...)
+	data = append(data, rsEncode(rs16, h.serpentSalt)...)
+	data = append(data, rsEncode(rs24, h.nonce)...)
+	data = append(data, rsEncode(rs64, h.keyHash)...)
+	data = append(data, rsEncode(rs32, h.keyfileHash)...)
+	data = append(data, rsEncode(rs64, h.authTag)...)
+	if h.extended() {
+		data = append(data, rsEncode(rs16, h.extFlags)...)
+	}
+	if h.appendable() {
+		data = append(data, rsEncode(rs16, h.generations)...)
+	}
+	for _, i := range h.keyfileIDs {
+		data = append(data, rsEncode(rs16, i)...)
+	}
+	if len(h.keyfileChecks) > 0 {
+		data = append(data, rsEncode(rs16, h.keyfileSalt)...)
+		for _, i := range h.keyfileChecks {
+			data = append(data, rsEncode(rs5, i)...)
+		}
+	}
+	if h.signed() {
+		data = append(data, rsEncode(rs32, h.signer)...)
+		data = append(data, rsEncode(rs64, h.signature)...)
+	}
+	_, err := fout.Write(data)
+	return err
+}
+
+// Read and decode a header, returning the first Reed-Solomon error encountered
+// Where the fields after the version are depends on the version, so a header
+// whose version can't be decoded can't be read any further
+var errVersionDamaged = errors.New("the header version is damaged")
+
+func readHeader(fin io.Reader) (*header, error) {
+	h := &header{}
+	var errs []error
+
+	// Read a field and decode it with the given encoder
+	field := func(rs *infectious.FEC) []byte {
+		tmp := make([]byte, rs.Total())
+		if _, err := io.ReadFull(fin, tmp); err != nil {
+			errs = append(errs, err)
+			return make([]byte, rs.Required())
+		}
+		tmp, err := rsDecode(rs, tmp, nil)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return tmp
+	}
+
+	h.version = string(field(rs5))
+	if len(errs) > 0 {
+		return h, errVersionDamaged
+	}
+	commentsLength, err := strconv.Atoi(string(field(rs5)))
 	if err != nil {
-		if rs.Total() == 136 {
-			return data[:128], err
+		errs = append(errs, err)
+	}
+	comments := make([]byte, commentsLength)
+	for i := range comments {
+		var err error
+		tmp := make([]byte, 3)
+		if _, err = io.ReadFull(fin, tmp); err == nil {
+			tmp, err = rsDecode(rs1, tmp, nil)
+		}
+		if err != nil {
+			h.commentsDamaged = true
 		}
-		return data[:rs.Total()/3], err
+		comments[i] = tmp[0]
 	}
-	return res, nil
+	h.comments = string(comments)
+
+	h.flags = field(rs5)
+	h.salt = field(rs16)
+	h.hkdfSalt = field(rs32)
+	h.serpentSalt = field(rs16)
+	h.nonce = field(rs24)
+	h.keyHash = field(rs64)
+	h.keyfileHash = field(rs32)
+	h.authTag = field(rs64)
+	if h.extended() {
+		h.extFlags = field(rs16)
+	}
+	if h.appendable() {
+		h.generations = field(rs16)
+	}
+	for i := 0; i < h.managedCount(); i++ {
+		h.keyfileIDs = append(h.keyfileIDs, field(rs16))
+	}
+	if h.keyfileCheckCount() > 0 {
+		h.keyfileSalt = field(rs16)
+		for i := 0; i < h.keyfileCheckCount(); i++ {
+			h.keyfileChecks = append(h.keyfileChecks, field(rs5))
+		}
+	}
+	if h.signed() {
+		h.signer = field(rs32)
+		h.signature = field(rs64)
+	}
+
+	if len(errs) > 0 {
+		return h, errs[0]
+	}
+	return h, nil
 }
 
-// PKCS#7 pad (for use with Reed-Solomon)
-func pad(data []byte) []byte {
-	padLen := 128 - len(data)%128
-	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
-	return append(data, padding...)
+// Verify the Ed25519 signature of a header
+func verifyHeader(h *header) bool {
+	return h.signed() && ed25519.Verify(h.signer, h.signedData(), h.signature)
 }
 
-// PKCS#7 unpad
-func unpad(data []byte) []byte {
-	padLen := int(data[127])
-	return data[:128-padLen]
+// Load an Ed25519 private key created by the "Create" button
+func loadSignKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid signing key")
+	}
+	key := ed25519.NewKeyFromSeed(data[:ed25519.SeedSize])
+	if !bytes.Equal(key, data) {
+		return nil, errors.New("invalid signing key")
+	}
+	return key, nil
 }
 
-// Generate a cryptographically secure password
-func genPassword() string {
-	chars := ""
-	if passgenUpper {
-		chars += "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// Load an Ed25519 public key (the .pub file written next to a signing key)
+func loadSignerKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	if passgenLower {
-		chars += "abcdefghijklmnopqrstuvwxyz"
+	if len(data) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
 	}
-	if passgenNums {
-		chars += "1234567890"
+	return ed25519.PublicKey(data), nil
+}
+
+// Short, human-readable identity of a signer's public key
+func fingerprint(key []byte) string {
+	sum := sha3.Sum256(key)
+	return formatFingerprint(sum[:8])
+}
+
+// Format 8 bytes of a hash in groups, like ABCD EF01 2345 6789
+func formatFingerprint(sum []byte) string {
+	tmp := strings.ToUpper(fmt.Sprintf("%x", sum))
+	return tmp[:4] + " " + tmp[4:8] + " " + tmp[8:12] + " " + tmp[12:]
+}
+
+// Derive the encryption key from a password with Argon2id
+func deriveKey(password string, salt []byte, paranoid bool) []byte {
+	if paranoid {
+		return argon2.IDKey(
+			[]byte(password),
+			salt,
+			8,     // 8 passes
+			1<<20, // 1 GiB memory
+			8,     // 8 threads
+			32,    // 32-byte output key
+		)
 	}
-	if passgenSymbols {
-		chars += "-=_+!@#$^&()?<>"
+	return argon2.IDKey(
+		[]byte(password),
+		salt,
+		4,
+		1<<20,
+		4,
+		32,
+	)
+}
+
+// Derive the key of a new volume from the password and keyfiles, filling in
+// the key hashes and keyfile checks of its header
+func createKey(h *header, password string, keyfiles []string) ([]byte, error) {
+	if h.keyfileOnly() && len(keyfiles) == 0 {
+		return nil, errors.New("keyfile-only mode needs keyfiles")
 	}
-	tmp := make([]byte, passgenLength)
-	for i := 0; i < int(passgenLength); i++ {
-		j, _ := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
-		tmp[i] = chars[j.Int64()]
+	var key, keyfileKey []byte
+	if !h.keyfileOnly() {
+		key = deriveKey(password, h.salt, h.flags[0] == 1)
 	}
-	if passgenCopy {
-		clipboard.WriteAll(string(tmp))
+	if len(keyfiles) > 0 {
+		var sums [][]byte
+		var err error
+		keyfileKey, h.keyfileHash, sums, err = hashKeyfiles(keyfiles, h.flags[2] == 1)
+		if err != nil {
+			return nil, err
+		}
+		h.recordKeyfileChecks(sums)
+		if h.keyfileOnly() {
+			key = keyfileOnlyKey(keyfileKey, h.salt)
+		}
+	}
+	tmp := sha3.New512()
+	tmp.Write(key)
+	h.keyHash = tmp.Sum(nil)
+	if !h.keyfileOnly() {
+		for i := range keyfileKey {
+			key[i] ^= keyfileKey[i]
+		}
 	}
-	return string(tmp)
+	return key, nil
 }
 
-// Convert done, total, and starting time to progress, speed, and ETA
-func statify(done int64, total int64, start time.Time) (float32, float64, string) {
-	progress := float32(done) / float32(total)
-	elapsed := float64(time.Since(start)) / float64(MiB) / 1000
-	speed := float64(done) / elapsed / float64(MiB)
-	eta := int(math.Floor(float64(total-done) / (speed * float64(MiB))))
-	return float32(math.Min(float64(progress), 1)), speed, timeify(eta)
+// Derive the key of an existing volume, checking the password and keyfiles
+func unlockKey(h *header, password string, keyfiles []string) ([]byte, error) {
+	if h.keyfileOnly() && h.flags[1] == 0 {
+		return nil, errors.New("the header is damaged")
+	}
+	var key []byte
+	if !h.keyfileOnly() {
+		key = deriveKey(password, h.salt, h.flags[0] == 1)
+		tmp := sha3.New512()
+		tmp.Write(key)
+		if subtle.ConstantTimeCompare(tmp.Sum(nil), h.keyHash) == 0 {
+			return nil, errors.New("the provided password is incorrect")
+		}
+	}
+	if h.flags[1] == 1 {
+		keyfileKey, keyfileHash, sums, err := hashKeyfiles(keyfiles, h.flags[2] == 1)
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare(keyfileHash, h.keyfileHash) == 0 {
+			return nil, incorrectKeyfiles(h, sums, h.flags[2] == 1)
+		}
+		if h.keyfileOnly() {
+			key = keyfileOnlyKey(keyfileKey, h.salt)
+		} else {
+			for i := range key {
+				key[i] ^= keyfileKey[i]
+			}
+		}
+	}
+	return key, nil
 }
 
-// Convert seconds to HH:MM:SS
-func timeify(seconds int) string {
-	hours := int(math.Floor(float64(seconds) / 3600))
-	seconds %= 3600
-	minutes := int(math.Floor(float64(seconds) / 60))
-	seconds %= 60
-	hours = int(math.Max(float64(hours), 0))
-	minutes = int(math.Max(float64(minutes), 0))
-	seconds = int(math.Max(float64(seconds), 0))
-	return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
+// Combine keyfiles into a keyfile key, also returning its SHA3-256 hash and
+// the SHA3-256 of every keyfile for the keyfile checks
+func hashKeyfiles(paths []string, ordered bool) ([]byte, []byte, [][]byte, error) {
+	// Shares are combined into their keys, which take the place of the first
+	// share of every key
+	keys, err := combineShares(paths)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var kept []string
+	for _, path := range paths {
+		if key, ok := keys[path]; !ok || key != nil {
+			kept = append(kept, path)
+		}
+	}
+	paths = kept
+	feed := func(w io.Writer, path string) error {
+		if key := keys[path]; key != nil {
+			w.Write(key)
+			return nil
+		}
+		return hashKeyfile(w, path)
+	}
+
+	var keyfileKey []byte
+	var sums [][]byte
+	if ordered { // If order matters, hash progressively
+		tmp := sha3.New256()
+		for _, path := range paths {
+			each := sha3.New256()
+			if err := feed(io.MultiWriter(tmp, each), path); err != nil {
+				return nil, nil, nil, err
+			}
+			sums = append(sums, each.Sum(nil))
+		}
+		keyfileKey = tmp.Sum(nil)
+	} else { // If order doesn't matter, hash individually and combine
+		for _, path := range paths {
+			tmp := sha3.New256()
+			if err := feed(tmp, path); err != nil {
+				return nil, nil, nil, err
+			}
+			sum := tmp.Sum(nil)
+			sums = append(sums, sum)
+			if keyfileKey == nil {
+				keyfileKey = append([]byte{}, sum...)
+			} else {
+				for i, j := range sum {
+					keyfileKey[i] ^= j
+				}
+			}
+		}
+	}
+
+	// Store a hash of the keyfile key for comparison
+	tmp := sha3.New256()
+	tmp.Write(keyfileKey)
+	return keyfileKey, tmp.Sum(nil), sums, nil
 }
 
-// Convert bytes to KiB, MiB, etc.
-func sizeify(size int64) string {
-	if size >= int64(TiB) {
-		return fmt.Sprintf("%.2f TiB", float64(size)/float64(TiB))
-	} else if size >= int64(GiB) {
-		return fmt.Sprintf("%.2f GiB", float64(size)/float64(GiB))
-	} else if size >= int64(MiB) {
-		return fmt.Sprintf("%.2f MiB", float64(size)/float64(MiB))
-	} else {
-		return fmt.Sprintf("%.2f KiB", float64(size)/float64(KiB))
+// A keyfile that couldn't be read
+type keyfileError struct {
+	path string
+	err  error
+}
+
+func (e *keyfileError) Error() string {
+	return fmt.Sprintf("keyfile %s can't be read: %v", e.path, e.err)
+}
+
+func (e *keyfileError) Unwrap() error {
+	return e.err
+}
+
+// Feed a keyfile into a hash a piece at a time, so even huge keyfiles
+// don't have to fit in memory. Managed keyfiles contribute their secret.
+func hashKeyfile(tmp io.Writer, path string) error {
+	keyfileLock.Lock()
+	secret, ok := unlockedKeyfiles[path]
+	keyfileLock.Unlock()
+	if ok {
+		tmp.Write(secret)
+		return nil
+	}
+	fin, err := os.Open(path)
+	if err != nil {
+		return &keyfileError{path, err}
 	}
+	defer fin.Close()
+
+	// A managed keyfile must be unlocked rather than used as it is
+	magic := make([]byte, len(keyfileMagic))
+	n, err := io.ReadFull(fin, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return &keyfileError{path, err}
+	}
+	if string(magic[:n]) == keyfileMagic {
+		return &keyfileError{path, errKeyfileLocked}
+	}
+	tmp.Write(magic[:n])
+	if _, err := io.Copy(tmp, fin); err != nil {
+		return &keyfileError{path, err}
+	}
+	return nil
 }
 
-func main() {
-	// Create the main window
-	window = giu.NewMasterWindow("Picocrypt", 318, 479, giu.MasterWindowFlagsNotResizable)
+// Number of plaintext bytes in a segment of a seekable volume, chosen so that
+// a segment and its 64-byte tag fill exactly 1 MiB
+var segmentSize = MiB - 64
 
-	// Start the dialog module
-	dialog.Init()
+// Number of plaintext bytes in a segment of an appendable volume, which also
+// starts with a random nonce and IV
+var appendSpan = segmentSize - 40
 
-	// Set callbacks
-	window.SetDropCallback(onDrop)
-	window.SetCloseCallback(func() bool {
-		return !working && !showProgress
+// Number of segments needed for a seekable volume (always at least one,
+// so that the final segment marks the end of the volume)
+func segmentCount(size int64) int64 {
+	count := (size + int64(segmentSize) - 1) / int64(segmentSize)
+	if count == 0 {
+		count = 1
+	}
+	return count
+}
+
+// Size of a volume with the given header and size of its contents
+func encodedSize(h *header, size int64) int64 {
+	stored := size
+	if h.extended() && h.extFlags[1] == 1 {
+		stored += 64 * segmentCount(size)
+	}
+	if h.flags[3] == 1 {
+		// Every 128 bytes become a block, and the final partial chunk is padded
+		n := int64(h.payloadCode().Total())
+		full, partial := stored/int64(MiB), stored%int64(MiB)
+		stored = full * int64(MiB/128) * n
+		if partial > 0 {
+			stored += (partial/128 + 1) * n
+		}
+	}
+	return h.size() + stored
+}
+
+// Chunk sizes of common media, for split sizes like "DVD"
+var splitPresets = map[string]int64{
+	"cd":     737280000,
+	"dvd":    4700372992,
+	"dvd-dl": 8543666176,
+	"bd":     25025314816,
+	"bd-dl":  50050629632,
+	"fat32":  4294967295,
+}
+
+// Units for split sizes, decimal and binary
+var splitMultipliers = map[string]int64{
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": int64(KiB),
+	"mib": int64(MiB),
+	"gib": int64(GiB),
+	"tib": int64(TiB),
+}
+
+// Parse a split size like "650", "4.7GB", "1.5 GiB", or "DVD" into bytes,
+// rounding down to whole bytes. Without a unit, the given one is used, and
+// "Total" means the number of chunks rather than their size.
+func parseSplitSize(text string, unit string) (int64, bool, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if size, ok := splitPresets[text]; ok {
+		return size, false, nil
+	}
+	number := strings.TrimRight(text, "abcdefghijklmnopqrstuvwxyz")
+	suffix := strings.TrimSpace(text[len(number):])
+	number = strings.TrimSpace(number)
+	if suffix == "" {
+		if unit == "Total" {
+			count, err := strconv.ParseInt(number, 10, 64)
+			if err != nil || count <= 0 {
+				return 0, true, errors.New("invalid number of chunks")
+			}
+			return count, true, nil
+		}
+		suffix = strings.ToLower(unit)
+	}
+	multiplier, ok := splitMultipliers[suffix]
+	value, valid := new(big.Rat).SetString(number)
+	if !ok || !valid || strings.ContainsAny(number, "/eE") {
+		return 0, false, errors.New("invalid split size")
+	}
+	value.Mul(value, new(big.Rat).SetInt64(multiplier))
+	size := new(big.Int).Quo(value.Num(), value.Denom())
+	if !size.IsInt64() || size.Int64() <= 0 {
+		return 0, false, errors.New("invalid split size")
+	}
+	return size.Int64(), false, nil
+}
+
+// Sizes of the chunks to split a volume of the given size into. A total
+// number of chunks is always met exactly, with the sizes differing by at
+// most one byte.
+func splitSizes(size int64) ([]int64, error) {
+	value, total, err := parseSplitSize(splitSize, splitUnits[splitSelected])
+	if err != nil {
+		return nil, err
+	}
+	var sizes []int64
+	if total {
+		if value > size || value > maxChunks {
+			return nil, errors.New("too many chunks")
+		}
+		for i := int64(0); i < value; i++ {
+			sizes = append(sizes, size/value)
+			if i < size%value {
+				sizes[i]++
+			}
+		}
+	} else {
+		if (size+value-1)/value > maxChunks {
+			return nil, errors.New("too many chunks")
+		}
+		for done := int64(0); done < size; done += value {
+			if size-done < value {
+				sizes = append(sizes, size-done)
+			} else {
+				sizes = append(sizes, value)
+			}
+		}
+	}
+	return sizes, nil
+}
+
+// Encrypts and authenticates each segment of a seekable volume on its own
+type segmentCipher struct {
+	key         []byte
+	nonce       []byte
+	serpent     cipher.Block
+	serpentSalt []byte
+	hkdfSalt    []byte
+	macKey      []byte
+	paranoid    bool
+	random      bool // Segments start with a random nonce and IV (appendable volumes)
+}
+
+// Derive the segment keys from the encryption key and header
+func newSegmentCipher(key []byte, h *header) *segmentCipher {
+	// The first two subkeys are the same as for a normal volume
+	subkeys := hkdf.New(sha3.New256, key, h.hkdfSalt, nil)
+	subkeys.Read(make([]byte, 32)) // The MAC subkey of the whole volume
+	serpentKey := make([]byte, 32)
+	subkeys.Read(serpentKey)
+	macKey := make([]byte, 32)
+	subkeys.Read(macKey)
+	s, _ := serpent.NewCipher(serpentKey)
+
+	return &segmentCipher{
+		key:         key,
+		nonce:       h.nonce,
+		serpent:     s,
+		serpentSalt: h.serpentSalt,
+		hkdfSalt:    h.hkdfSalt,
+		macKey:      macKey,
+		paranoid:    h.flags[0] == 1,
+		random:      h.appendable(),
+	}
+}
+
+// Apply the keystream of a segment (encryption and decryption are the same)
+func (c *segmentCipher) xor(index uint64, data []byte) {
+	// Each segment uses its own XChaCha20 nonce
+	nonce := make([]byte, 24)
+	copy(nonce, c.nonce)
+	binary.BigEndian.PutUint64(nonce[16:], binary.BigEndian.Uint64(nonce[16:])^index)
+	chacha, _ := chacha20.NewUnauthenticatedCipher(c.key, nonce)
+	chacha.XORKeyStream(data, data)
+
+	// Serpent continues the counter where the previous segment ended
+	if c.paranoid {
+		iv := addCounter(c.serpentSalt, index<<16) // 1 MiB is 2^16 blocks of Serpent
+		cipher.NewCTR(c.serpent, iv).XORKeyStream(data, data)
+	}
+}
+
+// Apply the keystream given by the random 24-byte nonce and 16-byte Serpent IV
+// of a segment of an appendable volume. Segments can be written again after an
+// interrupted append, or differently to copies of a volume, so their nonces
+// can't come from their index.
+func (c *segmentCipher) xorRandom(values []byte, data []byte) {
+	chacha, _ := chacha20.NewUnauthenticatedCipher(c.key, values[:24])
+	chacha.XORKeyStream(data, data)
+	if c.paranoid {
+		cipher.NewCTR(c.serpent, values[24:40]).XORKeyStream(data, data)
+	}
+}
+
+// Apply the keystream of a volume without random access at an offset of its
+// contents, which must be a multiple of 64 bytes
+func (c *segmentCipher) xorAt(offset int64, data []byte) {
+	nonce, serpentSalt := c.nonce, c.serpentSalt
+
+	// Recompute the nonce and IV that work() switches to every 60 GiB
+	if epoch := offset / int64(60*GiB); epoch > 0 {
+		subkeys := hkdf.New(sha3.New256, c.key, c.hkdfSalt, nil)
+		subkeys.Read(make([]byte, 64+40*(epoch-1)))
+		nonce = make([]byte, 24)
+		subkeys.Read(nonce)
+		serpentSalt = make([]byte, 16)
+		subkeys.Read(serpentSalt)
+		offset %= int64(60 * GiB)
+	}
+
+	chacha, _ := chacha20.NewUnauthenticatedCipher(c.key, nonce)
+	chacha.SetCounter(uint32(offset / 64))
+	chacha.XORKeyStream(data, data)
+	if c.paranoid {
+		iv := addCounter(serpentSalt, uint64(offset/16))
+		cipher.NewCTR(c.serpent, iv).XORKeyStream(data, data)
+	}
+}
+
+// Add to a big-endian 128-bit counter, returning a new slice
+func addCounter(iv []byte, n uint64) []byte {
+	res := make([]byte, len(iv))
+	copy(res, iv)
+	for i := len(res) - 1; i >= 0; i-- {
+		sum := uint64(res[i]) + n&0xff
+		res[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	return res
+}
+
+// Compute the tag of an encrypted segment
+func (c *segmentCipher) tag(index uint64, final bool, data []byte) []byte {
+	var mac hash.Hash
+	if c.paranoid {
+		mac = hmac.New(sha3.New512, c.macKey)
+	} else {
+		mac, _ = blake2b.New512(c.macKey)
+	}
+
+	// Include the position so segments can't be reordered or truncated
+	tmp := make([]byte, 9)
+	binary.BigEndian.PutUint64(tmp, index)
+	if final {
+		tmp[8] = 1
+	}
+	mac.Write(tmp)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Encrypt a segment and append its tag, which also covers the random nonce
+// and IV if the segment starts with them
+func (c *segmentCipher) seal(index uint64, final bool, src []byte) []byte {
+	if !c.random {
+		dst := make([]byte, len(src), len(src)+64)
+		copy(dst, src)
+		c.xor(index, dst)
+		return append(dst, c.tag(index, final, dst)...)
+	}
+	dst := make([]byte, 40, 40+len(src)+64)
+	rand.Read(dst)
+	dst = append(dst, src...)
+	c.xorRandom(dst[:40], dst[40:])
+	return append(dst, c.tag(index, final, dst)...)
+}
+
+// Verify and decrypt a segment, returning the plaintext even if it's damaged
+func (c *segmentCipher) open(index uint64, final bool, src []byte) ([]byte, error) {
+	prefix := 0
+	if c.random {
+		prefix = 40
+	}
+	if len(src) < prefix+64 {
+		return nil, errors.New("segment is truncated")
+	}
+	var err error
+	if subtle.ConstantTimeCompare(c.tag(index, final, src[:len(src)-64]), src[len(src)-64:]) == 0 {
+		err = errors.New("segment is damaged or modified")
+	}
+	dst := make([]byte, len(src)-prefix-64)
+	copy(dst, src[prefix:])
+	if c.random {
+		c.xorRandom(src[:40], dst)
+	} else {
+		c.xor(index, dst)
+	}
+	return dst, err
+}
+
+// A range of bytes of a file that is known to be bad, from start up to end
+type badRange struct {
+	start int64
+	end   int64
+}
+
+type badRanges []badRange
+
+// Mark which of the n bytes at an offset are bad, or return nil if none are
+func (b badRanges) erased(offset int64, n int) []byte {
+	var mask []byte
+	for _, i := range b {
+		start, end := i.start, i.end
+		if start < offset {
+			start = offset
+		}
+		if end > offset+int64(n) {
+			end = offset + int64(n)
+		}
+		if start >= end {
+			continue
+		}
+		if mask == nil {
+			mask = make([]byte, n)
+		}
+		for j := start; j < end; j++ {
+			mask[j-offset] = 1
+		}
+	}
+	return mask
+}
+
+// Reads a file, remembering sectors that fail to read (along with ranges
+// known to be bad beforehand) so Reed-Solomon can treat them as erasures
+type erasureReader struct {
+	r     io.ReaderAt
+	mutex sync.Mutex
+	bad   badRanges
+}
+
+func (e *erasureReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := e.r.ReadAt(p, off)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	// Read one 4 KiB sector at a time, zeroing the ones that fail
+	for i := 0; i < len(p); {
+		end := i + 4096 - int((off+int64(i))%4096)
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := e.r.ReadAt(p[i:end], off+int64(i))
+		if err == io.EOF {
+			return i + n, err
+		} else if err != nil {
+			for j := i; j < end; j++ {
+				p[j] = 0
+			}
+			e.mutex.Lock()
+			e.bad = append(e.bad, badRange{off + int64(i), off + int64(end)})
+			e.mutex.Unlock()
+		}
+		i = end
+	}
+	return len(p), nil
+}
+
+// Mark which of the n bytes at an offset are erasures, or return nil if none are
+func (e *erasureReader) erased(offset int64, n int) []byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.bad.erased(offset, n)
+}
+
+// Random access to the contents of a volume, only decrypting the parts that
+// are actually read. Segments of seekable volumes are verified as they're read,
+// other volumes are verified as a whole when opened.
+type volumeReader struct {
+	fin      io.ReaderAt
+	offset   int64 // Where the encrypted contents start
+	stored   int64 // Size of the encrypted contents on disk
+	decoded  int64 // Size of the encrypted contents without Reed-Solomon
+	size     int64 // Size of the decrypted contents
+	span     int64 // Size of the decrypted contents of a segment
+	segments int64
+	reedsolo bool
+	rs       *infectious.FEC // Reed-Solomon code of the contents
+	disk     *erasureReader  // Reads fin, keeping track of erasures
+	spread   bool            // Reed-Solomon blocks are interleaved
+	padded   bool
+	seekable bool
+	appends  bool // Segments are never final in appendable volumes
+	correct  bool // Always correct errors with Reed-Solomon
+	force    bool // Return damaged segments instead of an error
+	cipher   *segmentCipher
+
+	header     *header // Only set by openVolume
+	headerPath string  // Where the header was read from if it's detached
+
+	mutex sync.Mutex
+	index int64 // The most recently read segment is cached
+	cache []byte
+}
+
+// Open the contents of a volume of the given size (including the header) for
+// random access with the derived encryption key
+func newVolumeReader(fin io.ReaderAt, size int64, h *header, key []byte, bad badRanges) (*volumeReader, error) {
+	v := &volumeReader{
+		fin:      fin,
+		disk:     &erasureReader{r: fin, bad: bad},
+		offset:   h.size(),
+		stored:   size - h.size(),
+		reedsolo: h.flags[3] == 1,
+		padded:   h.flags[4] == 1,
+		seekable: h.extended() && h.extFlags[1] == 1,
+		appends:  h.appendable(),
+		rs:       h.payloadCode(),
+		spread:   h.interleaved(),
+		cipher:   newSegmentCipher(key, h),
+		index:    -1,
+	}
+	if v.reedsolo && v.rs == nil {
+		return nil, errors.New("unknown Reed-Solomon parity level")
+	}
+
+	// Appendable volumes only consist of full segments, and anything after
+	// the last one (left by an interrupted append) is ignored
+	if v.appends {
+		count := int64(binary.BigEndian.Uint64(h.generations))
+		chunk := int64(MiB)
+		if v.reedsolo {
+			chunk = int64(MiB / 128 * v.rs.Total())
+		}
+		if count == 0 || v.stored < count*chunk {
+			return nil, errors.New("volume is truncated")
+		}
+		v.stored, v.decoded, v.segments = count*chunk, count*int64(MiB), count
+		v.size, v.span = count*int64(appendSpan), int64(appendSpan)
+		return v, nil
+	}
+
+	// Find the size of the contents without Reed-Solomon
+	v.decoded = v.stored
+	if v.reedsolo && (v.stored > 0 || v.seekable) {
+		n := int64(v.rs.Total())
+		chunk := int64(MiB / 128 * v.rs.Total())
+		full, partial := v.stored/chunk, v.stored%chunk
+		if partial%n != 0 || v.stored < n {
+			return nil, errors.New("volume is truncated")
+		}
+
+		// Check how much of the final 128-byte block is padding
+		v.decoded = full * int64(MiB)
+		if partial > 0 {
+			v.decoded += (partial/n - 1) * 128
+		}
+		if partial > 0 || v.padded {
+			// An interleaved block is spread across the whole final chunk
+			last := n
+			if v.spread {
+				last = chunk
+				if partial > 0 {
+					last = partial
+				}
+			}
+			block := make([]byte, last)
+			if _, err := v.disk.ReadAt(block, v.offset+v.stored-last); err != nil {
+				return nil, err
+			}
+			erased := v.disk.erased(v.offset+v.stored-last, int(last))
+			if v.spread {
+				block = deinterleaveBlocks(block, int(n))[last-n:]
+				if erased != nil {
+					erased = deinterleaveBlocks(erased, int(n))[last-n:]
+				}
+			}
+			tmp, err := rsCorrect(v.rs, block, erased)
+			if err != nil || tmp[127] == 0 || tmp[127] > 128 {
+				return nil, errors.New("volume is damaged")
+			}
+			if partial > 0 {
+				v.decoded += int64(128 - tmp[127])
+			} else {
+				v.decoded -= int64(tmp[127])
+			}
+		}
+	}
+
+	v.segments = (v.decoded + int64(MiB) - 1) / int64(MiB)
+	if !v.seekable {
+		v.size = v.decoded
+		v.span = int64(MiB)
+		return v, v.verify(key, h)
+	}
+	if v.segments == 0 || v.decoded-(v.segments-1)*int64(MiB) < 64 {
+		return nil, errors.New("volume is truncated")
+	}
+	v.size = v.decoded - 64*v.segments
+	v.span = int64(segmentSize)
+	return v, nil
+}
+
+// The MAC of a whole volume, keyed with the first subkey from HKDF-SHA3
+func newVolumeMAC(key []byte, h *header) hash.Hash {
+	subkey := make([]byte, 32)
+	hkdf.New(sha3.New256, key, h.hkdfSalt, nil).Read(subkey)
+	if h.flags[0] == 1 {
+		return hmac.New(sha3.New512, subkey)
+	}
+	mac, _ := blake2b.New512(subkey)
+	return mac
+}
+
+// Check the authentication tag of a volume without random access
+func (v *volumeReader) verify(key []byte, h *header) error {
+	for _, correct := range []bool{false, true} {
+		if correct && !v.reedsolo {
+			break
+		}
+		v.correct = correct
+
+		mac := newVolumeMAC(key, h)
+		for i := int64(0); i < v.segments; i++ {
+			data, err := v.load(i, !correct)
+			if err != nil {
+				return err
+			}
+			mac.Write(data)
+		}
+		if subtle.ConstantTimeCompare(mac.Sum(nil), h.authTag) == 1 {
+			return nil
+		}
+	}
+	return errors.New("volume is damaged or modified")
+}
+
+// Size of the decrypted contents
+func (v *volumeReader) Size() int64 {
+	return v.size
+}
+
+// Close the underlying file, if there is one
+func (v *volumeReader) Close() error {
+	if closer, ok := v.fin.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Read the encrypted contents of a segment, decoding Reed-Solomon if needed
+func (v *volumeReader) load(index int64, fast bool) ([]byte, error) {
+	final := index == v.segments-1
+	if !v.reedsolo {
+		data := make([]byte, MiB)
+		if final {
+			data = data[:v.decoded-index*int64(MiB)]
+		}
+		_, err := v.disk.ReadAt(data, v.offset+index*int64(MiB))
+		return data, err
+	}
+
+	// Read the Reed-Solomon encoded segment
+	n := v.rs.Total()
+	chunk := int64(MiB / 128 * n)
+	raw := make([]byte, chunk)
+	if final {
+		raw = raw[:v.stored-index*chunk]
+	}
+	if _, err := v.disk.ReadAt(raw, v.offset+index*chunk); err != nil {
+		return nil, err
+	}
+	erased := v.disk.erased(v.offset+index*chunk, len(raw))
+	if v.spread {
+		raw = deinterleaveBlocks(raw, n)
+		if erased != nil {
+			erased = deinterleaveBlocks(erased, n)
+		}
+	}
+
+	var data []byte
+	for i := 0; i < len(raw); i += n {
+		var tmp []byte
+		if fast {
+			tmp = raw[i : i+128]
+		} else {
+			var mask []byte
+			if erased != nil {
+				mask = erased[i : i+n]
+			}
+			tmp, _ = rsCorrect(v.rs, raw[i:i+n], mask)
+		}
+		if final && i == len(raw)-n && (int64(len(raw)) < chunk || v.padded) {
+			if tmp[127] == 0 || tmp[127] > 128 {
+				return nil, errors.New("volume is damaged")
+			}
+			tmp = tmp[:128-tmp[127]]
+		}
+		data = append(data, tmp...)
+	}
+	return data, nil
+}
+
+// Read, verify, and decrypt a segment, also returning its tag if the volume
+// is seekable
+func (v *volumeReader) read(index int64) ([]byte, []byte, error) {
+	if !v.seekable {
+		data, err := v.load(index, !v.correct)
+		if err != nil {
+			return nil, nil, err
+		}
+		v.cipher.xorAt(index*int64(MiB), data)
+		return data, nil, nil
+	}
+
+	// Only correct errors if the segment doesn't verify, just like a normal decryption
+	final := index == v.segments-1 && !v.appends
+	var plain, data []byte
+	var err error
+	for _, fast := range []bool{true, false} {
+		if !fast && !v.reedsolo {
+			break
+		}
+		data, err = v.load(index, fast)
+		if err != nil {
+			continue
+		}
+		plain, err = v.cipher.open(uint64(index), final, data)
+		if err == nil {
+			break
+		}
+	}
+	if plain == nil {
+		return nil, nil, err
+	}
+	return plain, data[len(data)-64:], err
+}
+
+// Read from the decrypted contents at the given offset (implements io.ReaderAt)
+func (v *volumeReader) ReadAt(p []byte, off int64) (int, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	n := 0
+	for n < len(p) && off < v.size {
+		index := off / v.span
+		if index != v.index {
+			plain, _, err := v.read(index)
+			if err != nil && !(v.force && plain != nil) {
+				return n, err
+			}
+			v.index, v.cache = index, plain
+		}
+		start := off - index*v.span
+		if start >= int64(len(v.cache)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		read := copy(p[n:], v.cache[start:])
+		n += read
+		off += int64(read)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Open a volume for random access, checking the password and keyfiles. A
+// detached header is used if it's given instead of the volume, or if the
+// volume's own header is damaged and one is found next to it. The flag is
+// passed to os.OpenFile (os.O_RDWR for appending).
+func openVolume(path string, password string, keyfiles []string, flag int, bad badRanges) (*volumeReader, error) {
+	headerPath := ""
+	if strings.HasSuffix(path, ".pcvh") {
+		headerPath = path
+		path = strings.TrimSuffix(path, "h")
+	}
+	fin, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fin.Stat()
+	if err != nil {
+		fin.Close()
+		return nil, err
+	}
+
+	readFrom := func(path string) (*header, error) {
+		hin, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer hin.Close()
+		return readHeader(hin)
+	}
+	var h *header
+	if headerPath != "" {
+		h, err = readFrom(headerPath)
+	} else {
+		h, err = readHeader(fin)
+		if err != nil {
+			if tmp, err2 := readFrom(path + "h"); err2 == nil {
+				h, err, headerPath = tmp, nil, path+"h"
+			}
+		}
+	}
+	if err != nil {
+		fin.Close()
+		return nil, errors.New("the volume header is damaged")
+	}
+	if h.signed() && !verifyHeader(h) {
+		fin.Close()
+		return nil, errors.New("the volume signature is invalid")
+	}
+
+	// Derive the key and make sure it's correct
+	key, err := unlockKey(h, password, keyfiles)
+	if err != nil {
+		fin.Close()
+		return nil, err
+	}
+
+	v, err := newVolumeReader(fin, stat.Size(), h, key, bad)
+	if err != nil {
+		fin.Close()
+		return nil, err
+	}
+	v.header, v.headerPath = h, headerPath
+
+	// Segments are verified as they're read, but appendable volumes also need
+	// the tag of the volume to make sure no generation is missing
+	if v.appends {
+		tags, err := v.generationTags(h)
+		mac := newVolumeMAC(key, h)
+		if err == nil {
+			writeGenerationTags(mac, h, tags)
+		}
+		if err != nil || subtle.ConstantTimeCompare(mac.Sum(nil), h.authTag) == 0 {
+			fin.Close()
+			return nil, errors.New("the volume is damaged or modified")
+		}
+	}
+	return v, nil
+}
+
+// The tags of the last segment of every generation of an appendable volume
+func (v *volumeReader) generationTags(h *header) ([][]byte, error) {
+	_, comment, err := readZipDirectory(v, v.Size())
+	if err != nil {
+		return nil, err
+	}
+	generations := parseGenerations(comment)
+	count := binary.BigEndian.Uint64(h.generations[8:])
+	if uint64(len(generations)) != count || count == 0 || generations[count-1].segments != v.segments {
+		return nil, errors.New("the generations don't match the header")
+	}
+	var tags [][]byte
+	for _, g := range generations {
+		if g.segments < 1 || g.segments > v.segments {
+			return nil, errors.New("the generations don't match the header")
+		}
+		_, tag, err := v.read(g.segments - 1)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// Write what the tag of an appendable volume covers to its MAC
+func writeGenerationTags(mac hash.Hash, h *header, tags [][]byte) {
+	mac.Write(h.generations)
+	for _, tag := range tags {
+		mac.Write(tag)
+	}
+}
+
+// Decrypted contents that can be read at any offset (a volumeReader, or a
+// section of one for an earlier generation)
+type contents interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// A generation of an appendable volume, listed in the comment of its zip archive
+type generation struct {
+	time     time.Time
+	segments int64 // Number of segments up to and including this generation
+}
+
+// Writes new segments after the existing ones of an appendable volume
+type volumeWriter struct {
+	fout     *os.File
+	offset   int64 // Where the next segment is written
+	reedsolo bool
+	rs       *infectious.FEC
+	spread   bool
+	cipher   *segmentCipher
+	index    int64
+	buffer   []byte
+	tag      []byte // Tag of the most recently written segment
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		size := appendSpan - len(w.buffer)
+		if size > len(p) {
+			size = len(p)
+		}
+		w.buffer = append(w.buffer, p[:size]...)
+		p = p[size:]
+		if len(w.buffer) == appendSpan {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Seal the buffered segment and write it
+func (w *volumeWriter) flush() error {
+	data := w.cipher.seal(uint64(w.index), false, w.buffer)
+	w.tag = data[len(data)-64:]
+	if w.reedsolo {
+		tmp := make([]byte, 0, MiB/128*w.rs.Total())
+		for i := 0; i < len(data); i += 128 {
+			tmp = append(tmp, rsEncode(w.rs, data[i:i+128])...)
+		}
+		data = tmp
+		if w.spread {
+			data = interleaveBlocks(data, w.rs.Total())
+		}
+	}
+	if _, err := w.fout.WriteAt(data, w.offset); err != nil {
+		return err
+	}
+	w.offset += int64(len(data))
+	w.index++
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// Counts what zip.Writer writes to the volume, and captures its central
+// directory instead of writing it once 'capture' is set
+type zipSink struct {
+	w       io.Writer
+	n       int64
+	capture *bytes.Buffer
+}
+
+func (z *zipSink) Write(p []byte) (int, error) {
+	if z.capture != nil {
+		return z.capture.Write(p)
+	}
+	n, err := z.w.Write(p)
+	z.n += int64(n)
+	return n, err
+}
+
+// Create an empty appendable volume, ready for its first generation
+func createVolume(path string, password string, keyfiles []string, paranoid bool, reedsolo bool, parity int, interleave bool, keyfileOnly bool) (*volumeReader, error) {
+	flags := make([]byte, 5)
+	if paranoid {
+		flags[0] = 1
+	}
+	if len(keyfiles) > 0 {
+		flags[1] = 1
+	}
+	if reedsolo {
+		flags[3] = 1
+	}
+	extFlags := make([]byte, 16)
+	extFlags[1] = 1 // Seekable
+	extFlags[2] = 1 // Appendable
+	if reedsolo {
+		extFlags[3] = byte(parity)
+	}
+	if reedsolo && interleave {
+		extFlags[4] = 1
+	}
+	keyfileIDs := managedKeyfileIDs(keyfiles)
+	extFlags[5] = byte(len(keyfileIDs))
+	if keyfileOnly {
+		extFlags[9] = 1
+	}
+	h := &header{
+		version:     version,
+		flags:       flags,
+		salt:        make([]byte, 16),
+		hkdfSalt:    make([]byte, 32),
+		serpentSalt: make([]byte, 16),
+		nonce:       make([]byte, 24),
+		keyfileHash: make([]byte, 32),
+		authTag:     make([]byte, 64),
+		extFlags:    extFlags,
+		generations: make([]byte, 16),
+		keyfileIDs:  keyfileIDs,
+	}
+	h.prepareKeyfileChecks(keyfiles)
+	rand.Read(h.salt)
+	rand.Read(h.hkdfSalt)
+	rand.Read(h.serpentSalt)
+	rand.Read(h.nonce)
+
+	// Derive the key the same way as work()
+	key, err := createKey(h, password, keyfiles)
+	if err != nil {
+		return nil, err
+	}
+
+	fout, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHeader(fout, h); err != nil {
+		fout.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &volumeReader{
+		fin:      fout,
+		disk:     &erasureReader{r: fout},
+		offset:   h.size(),
+		reedsolo: reedsolo,
+		rs:       h.payloadCode(),
+		spread:   h.interleaved(),
+		seekable: true,
+		appends:  true,
+		span:     int64(appendSpan),
+		cipher:   newSegmentCipher(key, h),
+		header:   h,
+		index:    -1,
+	}, nil
+}
+
+// Append a new generation to a volume opened with os.O_RDWR (or created by
+// createVolume), containing the given files and folders. Files that haven't
+// changed since the previous generation are only referenced, not stored again.
+func appendGeneration(v *volumeReader, inputs []string, compress bool) error {
+	h := v.header
+	fout := v.fin.(*os.File)
+	if !h.appendable() {
+		return errors.New("the volume isn't appendable")
+	}
+	if h.signed() {
+		return errors.New("can't append to a signed volume")
+	}
+
+	// Read the central directory of the previous generation
+	var records [][]byte
+	var generations []generation
+	var tags [][]byte
+	previous := map[string]int{}
+	var archive *zip.Reader
+	if v.segments > 0 {
+		var comment string
+		var err error
+		records, comment, err = readZipDirectory(v, v.Size())
+		if err != nil {
+			return err
+		}
+		generations = parseGenerations(comment)
+		if tags, err = v.generationTags(h); err != nil {
+			return err
+		}
+		archive, err = zip.NewReader(v, v.Size())
+		if err != nil || len(archive.File) != len(records) {
+			return errors.New("the volume doesn't contain a zip archive")
+		}
+		for i, f := range archive.File {
+			previous[f.Name] = i
+		}
+	}
+
+	// Remove anything left by an interrupted append
+	if err := fout.Truncate(v.offset + v.stored); err != nil {
+		return err
+	}
+
+	// New files are written as zip entries after the previous generation
+	base := v.Size()
+	w := &volumeWriter{
+		fout:     fout,
+		offset:   v.offset + v.stored,
+		reedsolo: v.reedsolo,
+		rs:       v.rs,
+		spread:   v.spread,
+		cipher:   v.cipher,
+		index:    v.segments,
+	}
+	sink := &zipSink{w: w}
+	writer := zip.NewWriter(sink)
+	writer.SetOffset(base)
+	var entries [][]byte // Nil for new entries until their records are known
+	for _, input := range inputs {
+		input = filepath.Clean(input)
+		err := filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			name, _ := filepath.Rel(filepath.Dir(input), path)
+			name = filepath.ToSlash(name)
+
+			// Reuse unchanged files
+			if i, ok := previous[name]; ok {
+				f := archive.File[i]
+				if f.UncompressedSize64 == uint64(info.Size()) && f.Modified.Unix() == info.ModTime().Unix() {
+					entries = append(entries, records[i])
+					return nil
+				}
+			}
+
+			header := &zip.FileHeader{Name: name, Modified: info.ModTime(), Method: zip.Store}
+			if compress {
+				header.Method = zip.Deflate
+			}
+			entry, err := writer.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			fin, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(entry, fin)
+			fin.Close()
+			entries = append(entries, nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Take the central directory records of the new entries
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	sink.capture = &bytes.Buffer{}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	added := sink.capture.Bytes()
+
+	// The end of the last entry is only written when closing, so anything
+	// before the central directory (whose offset is in the end record) still
+	// belongs to the entries
+	record := added[len(added)-22:]
+	offset := int64(binary.LittleEndian.Uint32(record[16:]))
+	if offset == 0xffffffff {
+		offset = int64(binary.LittleEndian.Uint64(added[len(added)-22-20-56+48:]))
+	}
+	if _, err := w.Write(added[:offset-base-sink.n]); err != nil {
+		return err
+	}
+	added = added[offset-base-sink.n:]
+	sink.n = offset - base
+	end := base + sink.n
+	for i := range entries {
+		if entries[i] != nil {
+			continue
+		}
+		if len(added) < 46 || binary.LittleEndian.Uint32(added) != 0x02014b50 {
+			return errors.New("invalid zip directory")
+		}
+		n := 46 + int(binary.LittleEndian.Uint16(added[28:])) +
+			int(binary.LittleEndian.Uint16(added[30:])) + int(binary.LittleEndian.Uint16(added[32:]))
+		entries[i], added = added[:n], added[n:]
+	}
+	directory := bytes.Join(entries, nil)
+
+	// Pad the generation to whole segments, so the next one can start
+	// with a new segment. The padding goes before the central directory.
+	zip64 := len(entries) >= 0xffff || end+int64(appendSpan+len(directory)) >= 0xffffffff
+	now := time.Now()
+	segments := v.segments + 1
+	var comment string
+	var padding int64
+	for {
+		comment = formatGenerations(append(generations, generation{now, segments}))
+		size := end + int64(len(directory)) + int64(len(zipEnd(0, 0, 0, comment, zip64)))
+		padding = segments*int64(appendSpan) - size
+		if padding >= 0 {
+			break
+		}
+		segments = (size + int64(appendSpan) - 1) / int64(appendSpan)
+	}
+	if len(comment) > 0xffff {
+		return errors.New("the volume has too many generations")
+	}
+	for _, data := range [][]byte{
+		make([]byte, padding),
+		directory,
+		zipEnd(len(entries), int64(len(directory)), end+padding, comment, zip64),
+	} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if len(w.buffer) != 0 || w.index != segments {
+		return errors.New("generation isn't aligned to segments")
+	}
+	if err := fout.Sync(); err != nil {
+		return err
+	}
+
+	// The tag of the volume covers the number of segments and generations
+	// and the last segment of every generation, whose tag covers its index
+	binary.BigEndian.PutUint64(h.generations, uint64(segments))
+	binary.BigEndian.PutUint64(h.generations[8:], uint64(len(generations)+1))
+	mac := newVolumeMAC(v.cipher.key, h)
+	writeGenerationTags(mac, h, append(tags, w.tag))
+	h.authTag = mac.Sum(nil)
+
+	// Only write the header where it was read from (a detached header leaves
+	// random data in the volume), and keep a backup up to date
+	var data bytes.Buffer
+	writeHeader(&data, h)
+	if v.headerPath != "" {
+		return os.WriteFile(v.headerPath, data.Bytes(), 0644)
+	}
+	if _, err := fout.WriteAt(data.Bytes(), 0); err != nil {
+		return err
+	}
+	if _, err := os.Stat(fout.Name() + "h"); err == nil {
+		return os.WriteFile(fout.Name()+"h", data.Bytes(), 0644)
+	}
+	return nil
+}
+
+// Read the raw central directory records and the comment of a zip archive
+func readZipDirectory(r io.ReaderAt, size int64) ([][]byte, string, error) {
+	invalid := errors.New("the volume doesn't contain a zip archive")
+
+	// Find the end of central directory record
+	tail := int64(22 + 65535)
+	if tail > size {
+		tail = size
+	}
+	buf := make([]byte, tail)
+	if _, err := r.ReadAt(buf, size-tail); err != nil {
+		return nil, "", err
+	}
+	end := -1
+	for i := len(buf) - 22; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == 0x06054b50 &&
+			i+22+int(binary.LittleEndian.Uint16(buf[i+20:])) == len(buf) {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return nil, "", invalid
+	}
+	record := buf[end:]
+	count := uint64(binary.LittleEndian.Uint16(record[10:]))
+	dirSize := uint64(binary.LittleEndian.Uint32(record[12:]))
+	dirOffset := uint64(binary.LittleEndian.Uint32(record[16:]))
+	comment := string(record[22:])
+
+	// Zip64 archives store the values in another record
+	if count == 0xffff || dirSize == 0xffffffff || dirOffset == 0xffffffff {
+		locator := make([]byte, 20)
+		if _, err := r.ReadAt(locator, size-tail+int64(end)-20); err != nil {
+			return nil, "", invalid
+		}
+		if binary.LittleEndian.Uint32(locator) != 0x07064b50 {
+			return nil, "", invalid
+		}
+		record = make([]byte, 56)
+		if _, err := r.ReadAt(record, int64(binary.LittleEndian.Uint64(locator[8:]))); err != nil {
+			return nil, "", invalid
+		}
+		if binary.LittleEndian.Uint32(record) != 0x06064b50 {
+			return nil, "", invalid
+		}
+		count = binary.LittleEndian.Uint64(record[32:])
+		dirSize = binary.LittleEndian.Uint64(record[40:])
+		dirOffset = binary.LittleEndian.Uint64(record[48:])
+	}
+	if dirOffset+dirSize > uint64(size) {
+		return nil, "", invalid
+	}
+
+	// Split the central directory into records
+	directory := make([]byte, dirSize)
+	if _, err := r.ReadAt(directory, int64(dirOffset)); err != nil {
+		return nil, "", err
+	}
+	var records [][]byte
+	for len(directory) > 0 {
+		if len(directory) < 46 || binary.LittleEndian.Uint32(directory) != 0x02014b50 {
+			return nil, "", invalid
+		}
+		n := 46 + int(binary.LittleEndian.Uint16(directory[28:])) +
+			int(binary.LittleEndian.Uint16(directory[30:])) + int(binary.LittleEndian.Uint16(directory[32:]))
+		if n > len(directory) {
+			return nil, "", invalid
+		}
+		records = append(records, directory[:n])
+		directory = directory[n:]
+	}
+	if uint64(len(records)) != count {
+		return nil, "", invalid
+	}
+	return records, comment, nil
+}
+
+// Build the records following the central directory of a zip archive
+func zipEnd(count int, dirSize int64, dirOffset int64, comment string, zip64 bool) []byte {
+	var data []byte
+	if zip64 {
+		record := make([]byte, 56+20)
+		binary.LittleEndian.PutUint32(record, 0x06064b50)
+		binary.LittleEndian.PutUint64(record[4:], 44)
+		binary.LittleEndian.PutUint16(record[12:], 45)
+		binary.LittleEndian.PutUint16(record[14:], 45)
+		binary.LittleEndian.PutUint64(record[24:], uint64(count))
+		binary.LittleEndian.PutUint64(record[32:], uint64(count))
+		binary.LittleEndian.PutUint64(record[40:], uint64(dirSize))
+		binary.LittleEndian.PutUint64(record[48:], uint64(dirOffset))
+
+		// The locator of the zip64 record
+		binary.LittleEndian.PutUint32(record[56:], 0x07064b50)
+		binary.LittleEndian.PutUint64(record[64:], uint64(dirOffset+dirSize))
+		binary.LittleEndian.PutUint32(record[72:], 1)
+		data = record
+		count, dirSize, dirOffset = 0xffff, 0xffffffff, 0xffffffff
+	}
+
+	record := make([]byte, 22)
+	binary.LittleEndian.PutUint32(record, 0x06054b50)
+	binary.LittleEndian.PutUint16(record[8:], uint16(count))
+	binary.LittleEndian.PutUint16(record[10:], uint16(count))
+	binary.LittleEndian.PutUint32(record[12:], uint32(dirSize))
+	binary.LittleEndian.PutUint32(record[16:], uint32(dirOffset))
+	binary.LittleEndian.PutUint16(record[20:], uint16(len(comment)))
+	data = append(data, record...)
+	return append(data, comment...)
+}
+
+// Parse the generations listed in the comment of an appendable volume's archive
+func parseGenerations(comment string) []generation {
+	var generations []generation
+	lines := strings.Split(comment, "\n")
+	if lines[0] != "Picocrypt generations" {
+		return nil
+	}
+	for _, line := range lines[1:] {
+		var seconds, segments int64
+		if _, err := fmt.Sscanf(line, "%d %d", &seconds, &segments); err == nil {
+			generations = append(generations, generation{time.Unix(seconds, 0), segments})
+		}
+	}
+	return generations
+}
+
+// Format the generations for the comment of an appendable volume's archive
+func formatGenerations(generations []generation) string {
+	comment := "Picocrypt generations"
+	for _, i := range generations {
+		comment += fmt.Sprintf("\n%d %d", i.time.Unix(), i.segments)
+	}
+	return comment
+}
+
+// The Reed-Solomon encoders of the fields of an encoded header, in order
+func headerCodes(h *header) []*infectious.FEC {
+	codes := []*infectious.FEC{rs5, rs5}
+	for range h.comments {
+		codes = append(codes, rs1)
+	}
+	codes = append(codes, rs5, rs16, rs32, rs16, rs24, rs64, rs32, rs64)
+	if h.extended() {
+		codes = append(codes, rs16)
+	}
+	if h.appendable() {
+		codes = append(codes, rs16)
+	}
+	for i := 0; i < h.managedCount(); i++ {
+		codes = append(codes, rs16)
+	}
+	if h.keyfileCheckCount() > 0 {
+		codes = append(codes, rs16)
+		for i := 0; i < h.keyfileCheckCount(); i++ {
+			codes = append(codes, rs5)
+		}
+	}
+	if h.signed() {
+		codes = append(codes, rs32, rs64)
+	}
+	return codes
+}
+
+// Correct a Reed-Solomon block, returning it re-encoded along with how many
+// of its bytes were wrong
+func rsRepair(rs *infectious.FEC, block []byte, erased []byte) ([]byte, int, error) {
+	// Most blocks are intact, which is much faster to check than to decode
+	encoded := rsEncode(rs, block[:rs.Required()])
+	if bytes.Equal(encoded, block) {
+		return encoded, 0, nil
+	}
+	data, err := rsCorrect(rs, block, erased)
+	if err != nil {
+		return block, 0, err
+	}
+	encoded = rsEncode(rs, data)
+	wrong := 0
+	for i := range encoded {
+		if encoded[i] != block[i] {
+			wrong++
+		}
+	}
+	return encoded, wrong, nil
+}
+
+// Repair the header and contents of a volume without the password, writing
+// the corrected volume to a new file. Returns how many bytes were corrected
+// and how many blocks are damaged beyond repair (those are copied as they are).
+func repairVolume(path string, output string, bad badRanges) (corrected int64, damaged int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	fin := &erasureReader{r: file, bad: bad}
+
+	// A detached header isn't repaired, since its volume only has random data
+	// in the header's place
+	if strings.HasSuffix(path, ".pcvh") {
+		return 0, 0, errors.New("detached headers can't be repaired")
+	}
+	beyondRepair := errors.New("the volume header is damaged beyond repair")
+	truncated := errors.New("the volume is truncated")
+	if _, err := os.Stat(path + "h"); err == nil {
+		// The random data in place of a detached header looks like either
+		beyondRepair = errors.New("the volume header is damaged beyond repair or detached, and detached headers can't be repaired")
+		truncated = beyondRepair
+	}
+
+	// The version, comments length, flags, and extended flags decide where the
+	// other fields are and how the contents are encoded, so they have to be
+	// intact. Errors in the other fields are repaired below.
+	h, err := readHeader(io.NewSectionReader(fin, 0, 1<<62))
+	if err == errVersionDamaged {
+		return 0, 0, beyondRepair
+	}
+	layout := map[int][]byte{
+		0:                   []byte(h.version),
+		1:                   []byte(fmt.Sprintf("%05d", len(h.comments))),
+		len(h.comments) + 2: h.flags,
+	}
+	if h.extended() {
+		layout[len(h.comments)+10] = h.extFlags
+	}
+	raw := make([]byte, h.size())
+	if _, err := fin.ReadAt(raw, 0); err != nil {
+		return 0, 0, truncated
+	}
+	erased := fin.erased(0, len(raw))
+	var fixed []byte
+	codes := headerCodes(h)
+	for i, rs := range codes {
+		block := raw[:rs.Total()]
+		raw = raw[rs.Total():]
+		var mask []byte
+		if erased != nil {
+			mask, erased = erased[:rs.Total()], erased[rs.Total():]
+		}
+		encoded, wrong, err := rsRepair(rs, block, mask)
+		if value, ok := layout[i]; ok {
+			// The header must have been read with the repaired values
+			if err != nil {
+				return 0, 0, beyondRepair
+			}
+			if repaired, _ := rsDecode(rs, encoded, nil); !bytes.Equal(repaired, value) {
+				return 0, 0, beyondRepair
+			}
+		} else if err != nil {
+			damaged++
+		}
+		corrected += int64(wrong)
+		fixed = append(fixed, encoded...)
+	}
+	rs := h.payloadCode()
+	if h.flags[3] == 1 && rs == nil {
+		return 0, 0, errors.New("unknown Reed-Solomon parity level")
+	}
+
+	fout, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		fout.Close()
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+	if _, err := fout.Write(fixed); err != nil {
+		return 0, 0, err
+	}
+
+	// Contents without Reed-Solomon can't be repaired
+	if h.flags[3] != 1 {
+		_, err = io.Copy(fout, io.NewSectionReader(fin, h.size(), 1<<62))
+		return corrected, damaged, err
+	}
+
+	// Repair one chunk at a time, the same way they were encoded
+	size := rs.Total()
+	chunk := make([]byte, MiB/128*size)
+	for offset := h.size(); ; offset += int64(len(chunk)) {
+		n, err := fin.ReadAt(chunk, offset)
+		if n == 0 {
+			if err != io.EOF {
+				return corrected, damaged, err
+			}
+			break
+		}
+		data := chunk[:n]
+
+		// An incomplete final block can't be decoded
+		tail := data[n-n%size:]
+		data = data[:n-n%size]
+		if len(tail) > 0 {
+			damaged++
+		}
+		erased := fin.erased(offset, len(data))
+		if h.interleaved() {
+			data = deinterleaveBlocks(data, size)
+			if erased != nil {
+				erased = deinterleaveBlocks(erased, size)
+			}
+		}
+		repaired := make([]byte, 0, n)
+		for i := 0; i < len(data); i += size {
+			var mask []byte
+			if erased != nil {
+				mask = erased[i : i+size]
+			}
+			encoded, wrong, err := rsRepair(rs, data[i:i+size], mask)
+			if err != nil {
+				damaged++
+			}
+			corrected += int64(wrong)
+			repaired = append(repaired, encoded...)
+		}
+		if h.interleaved() {
+			repaired = interleaveBlocks(repaired, size)
+		}
+		if _, err := fout.Write(append(repaired, tail...)); err != nil {
+			return corrected, damaged, err
+		}
+		if n < len(chunk) {
+			break
+		}
+	}
+	return corrected, damaged, nil
+}
+
+// The contents of a generation of an appendable volume (the latest one if 0)
+func snapshot(v *volumeReader, number int) (contents, error) {
+	if number == 0 {
+		return v, nil
+	}
+	_, comment, err := readZipDirectory(v, v.Size())
+	if err != nil {
+		return nil, err
+	}
+	generations := parseGenerations(comment)
+	if number < 0 || number > len(generations) {
+		return nil, fmt.Errorf("the volume has no generation %d", number)
+	}
+	return io.NewSectionReader(v, 0, generations[number-1].segments*int64(appendSpan)), nil
+}
+
+// Find the highest number of the chunks of a split volume, or -1 if there
+// are none. Chunks before it may be missing.
+func lastChunk(path string) int {
+	last := -1
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	prefix := filepath.Base(path) + "."
+	for _, i := range entries {
+		if !strings.HasPrefix(i.Name(), prefix) {
+			continue
+		}
+		suffix := i.Name()[len(prefix):]
+		if n, err := strconv.Atoi(suffix); err == nil && n > last && strconv.Itoa(n) == suffix {
+			last = n
+		}
+	}
+	return last
+}
+
+// Reed-Solomon encoder
+func rsEncode(rs *infectious.FEC, data []byte) []byte {
+	res := make([]byte, rs.Total())
+	rs.Encode(data, func(s infectious.Share) {
+		res[s.Number] = s.Data[0]
+	})
+	return res
+}
+
+// Reed-Solomon decoder
+func rsDecode(rs *infectious.FEC, data []byte, erased []byte) ([]byte, error) {
+	// If fast decode, just return the first 128 bytes of the contents
+	if rs.Required() == 128 && fastDecode {
+		return data[:128], nil
+	}
+	return rsCorrect(rs, data, erased)
+}
+
+// Reed-Solomon decoder that always corrects errors. Bytes marked in 'erased'
+// (if not nil) are left out and corrected as erasures, which only needs one
+// parity byte each instead of two.
+func rsCorrect(rs *infectious.FEC, data []byte, erased []byte) ([]byte, error) {
+	tmp := make([]infectious.Share, 0, rs.Total())
+	for i := 0; i < rs.Total(); i++ {
+		if erased != nil && erased[i] == 1 {
+			continue
+		}
+		tmp = append(tmp, infectious.Share{Number: i, Data: []byte{data[i]}})
+	}
+	res, err := rs.Decode(nil, tmp)
+
+	// Force decode the data but return the error as well
+	if err != nil {
+		return data[:rs.Required()], err
+	}
+	return res, nil
+}
+
+// Interleave a chunk of Reed-Solomon blocks, so the first byte of every block
+// comes first, then the second byte of every block, and so on. A burst of
+// damage then only hits a few bytes of each block instead of whole blocks.
+func interleaveBlocks(data []byte, size int) []byte {
+	count := len(data) / size
+	res := make([]byte, len(data))
+	for i := 0; i < count; i++ {
+		for j := 0; j < size; j++ {
+			res[j*count+i] = data[i*size+j]
+		}
+	}
+	return res
+}
+
+// Undo interleaveBlocks
+func deinterleaveBlocks(data []byte, size int) []byte {
+	count := len(data) / size
+	res := make([]byte, len(data))
+	for i := 0; i < count; i++ {
+		for j := 0; j < size; j++ {
+			res[i*size+j] = data[j*count+i]
+		}
+	}
+	return res
+}
+
+// PKCS#7 pad (for use with Reed-Solomon)
+func pad(data []byte) []byte {
+	padLen := 128 - len(data)%128
+	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
+	return append(data, padding...)
+}
+
+// PKCS#7 unpad
+func unpad(data []byte) []byte {
+	padLen := int(data[127])
+	return data[:128-padLen]
+}
+
+// The password generator with the selected settings
+func passgenSettings() *passwordGenerator {
+	g := &passwordGenerator{
+		length:      int(passgenLength),
+		noAmbiguous: passgenNoAmbiguous,
+		requireEach: passgenRequireEach,
+	}
+	if passgenUpper {
+		g.sets = append(g.sets, upperChars)
+	}
+	if passgenLower {
+		g.sets = append(g.sets, lowerChars)
+	}
+	if passgenNums {
+		g.sets = append(g.sets, numberChars)
+	}
+	if passgenSymbols {
+		g.sets = append(g.sets, passgenSymbolSet)
+	}
+	if passgenCustom {
+		g.sets = append(g.sets, passgenCustomSet)
+	}
+	return g
+}
+
+// Generate a cryptographically secure password or passphrase
+func genPassword() string {
+	var tmp string
+	if passgenMode == 1 {
+		words := wordlists[passgenWordlist]
+		tmp = genPassphrase(words, int(passgenWordCount), passgenSeparator, passgenCapitalize, passgenNumber)
+	} else {
+		tmp, _ = passgenSettings().generate()
+	}
+	if passgenCopy {
+		copyPassword(tmp)
+	}
+	return tmp
+}
+
+// Describe the entropy of the passwords the generator currently makes, or
+// why it can't make any
+func passgenLabel() string {
+	if passgenMode == 1 {
+		return fmt.Sprintf("Entropy: %.1f bits.", passphraseEntropy(len(wordlists[passgenWordlist]), int(passgenWordCount), passgenNumber))
+	}
+	g := passgenSettings()
+	if err := g.check(); err != nil {
+		return strings.ToUpper(err.Error()[:1]) + err.Error()[1:] + "."
+	}
+	return fmt.Sprintf("Entropy: %.1f bits.", g.entropy())
+}
+
+// Convert done, total, and starting time to progress, speed, and ETA
+func statify(done int64, total int64, start time.Time) (float32, float64, string) {
+	progress := float32(done) / float32(total)
+	elapsed := float64(time.Since(start)) / float64(MiB) / 1000
+	speed := float64(done) / elapsed / float64(MiB)
+	eta := int(math.Floor(float64(total-done) / (speed * float64(MiB))))
+	return float32(math.Min(float64(progress), 1)), speed, timeify(eta)
+}
+
+// Convert seconds to HH:MM:SS
+func timeify(seconds int) string {
+	hours := int(math.Floor(float64(seconds) / 3600))
+	seconds %= 3600
+	minutes := int(math.Floor(float64(seconds) / 60))
+	seconds %= 60
+	hours = int(math.Max(float64(hours), 0))
+	minutes = int(math.Max(float64(minutes), 0))
+	seconds = int(math.Max(float64(seconds), 0))
+	return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
+}
+
+// Convert bytes to KiB, MiB, etc.
+func sizeify(size int64) string {
+	if size >= int64(TiB) {
+		return fmt.Sprintf("%.2f TiB", float64(size)/float64(TiB))
+	} else if size >= int64(GiB) {
+		return fmt.Sprintf("%.2f GiB", float64(size)/float64(GiB))
+	} else if size >= int64(MiB) {
+		return fmt.Sprintf("%.2f MiB", float64(size)/float64(MiB))
+	} else {
+		return fmt.Sprintf("%.2f KiB", float64(size)/float64(KiB))
+	}
+}
+
+// The commands, with how many arguments each needs at least
+var commands = map[string]int{
+	"list": 1, "extract": 2, "mount": 2, "append": 2, "generations": 1, "repair": 2, "keyfile": 1, "shares": 1,
+	"passgen": 0, "init": 1, "backup": 2, "restore": 2, "snapshots": 1, "prune": 1,
+}
+
+// Run a command instead of the GUI, returning the exit code
+func command(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  picocrypt list [-k keyfile]... [-g generation] volume")
+		fmt.Fprintln(os.Stderr, "  picocrypt extract [-k keyfile]... [-g generation] [-o dir] volume path...")
+		fmt.Fprintln(os.Stderr, "  picocrypt mount [-k keyfile]... [-g generation] volume mountpoint")
+		fmt.Fprintln(os.Stderr, "  picocrypt append [-k keyfile]... [-keyfile-only] [-paranoid] [-reedsolo] [-parity n] [-interleave] [-compress] volume path...")
+		fmt.Fprintln(os.Stderr, "  picocrypt generations [-k keyfile]... volume")
+		fmt.Fprintln(os.Stderr, "  picocrypt repair [-bad start-end]... volume output")
+		fmt.Fprintln(os.Stderr, "  picocrypt keyfile [-label text] keyfile")
+		fmt.Fprintln(os.Stderr, "  picocrypt shares [-threshold k] [-count n] name")
+		fmt.Fprintln(os.Stderr, "  picocrypt passgen [-length n] [-upper=false] [-lower=false] [-numbers=false] [-symbols chars] [-custom chars] [-no-ambiguous] [-require-each]")
+		fmt.Fprintln(os.Stderr, "  picocrypt passgen -words n [-wordlist short] [-separator text] [-capitalize] [-add-number]")
+		fmt.Fprintln(os.Stderr, "  picocrypt init [-k keyfile]... [-keyfile-only] [-paranoid] repository")
+		fmt.Fprintln(os.Stderr, "  picocrypt backup [-k keyfile]... repository path...")
+		fmt.Fprintln(os.Stderr, "  picocrypt restore [-k keyfile]... [-o dir] repository snapshot [path...]")
+		fmt.Fprintln(os.Stderr, "  picocrypt snapshots [-k keyfile]... repository")
+		fmt.Fprintln(os.Stderr, "  picocrypt prune [-k keyfile]... [-keep n] repository [snapshot...]")
+		fmt.Fprintln(os.Stderr, "Instead of standard input, the password can come from -password-fd n, -password-env name, -password-file path, or -password-command command.")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	if _, ok := commands[args[0]]; !ok {
+		return usage()
+	}
+
+	var keyfiles []string
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Func("k", "use a keyfile (can be repeated)", func(path string) error {
+		keyfiles = append(keyfiles, path)
+		return nil
+	})
+	var bad badRanges
+	flags.Func("bad", "treat a range of bytes as erasures, like 4096-8192 (can be repeated)", func(value string) error {
+		var start, end int64
+		if _, err := fmt.Sscanf(value, "%d-%d", &start, &end); err != nil || start < 0 || end <= start {
+			return errors.New("expected a range like 4096-8192")
+		}
+		bad = append(bad, badRange{start, end})
+		return nil
+	})
+	number := flags.Int("g", 0, "use an earlier generation of an appendable volume")
+	output := flags.String("o", ".", "extract into this folder")
+	paranoid := flags.Bool("paranoid", false, "use paranoid mode when creating a volume")
+	keyfileOnly := flags.Bool("keyfile-only", false, "use keyfiles only, without a password, when creating a volume")
+	reedsolo := flags.Bool("reedsolo", false, "use Reed-Solomon when creating a volume")
+	spread := flags.Bool("interleave", false, "interleave Reed-Solomon blocks when creating a volume")
+	parityBytes := flags.Int("parity", 8, "Reed-Solomon parity bytes per 128 bytes (8, 16, 32, or 64)")
+	compress := flags.Bool("compress", false, "compress new files with Deflate")
+	keep := flags.Int("keep", -1, "when pruning, keep only this many of the newest snapshots")
+	label := flags.String("label", "", "label of a new managed keyfile")
+	threshold := flags.Int("threshold", 2, "shares needed to rebuild a key split into shares")
+	count := flags.Int("count", 3, "number of shares to split a key into")
+	passwordFd := flags.Int("password-fd", -1, "read the password from this file descriptor")
+	passwordEnv := flags.String("password-env", "", "read the password from this environment variable")
+	passwordFile := flags.String("password-file", "", "read the password from the first line of this file")
+	passwordCommand := flags.String("password-command", "", "read the password from the first line a command prints, like \"pass show backup\"")
+	length := flags.Int("length", 32, "length of a generated password")
+	upper := flags.Bool("upper", true, "use uppercase letters in a generated password")
+	lower := flags.Bool("lower", true, "use lowercase letters in a generated password")
+	numbers := flags.Bool("numbers", true, "use numbers in a generated password")
+	symbols := flags.String("symbols", symbolChars, "symbols to use in a generated password")
+	custom := flags.String("custom", "", "more characters to use in a generated password")
+	noAmbiguous := flags.Bool("no-ambiguous", false, "leave out characters that are easy to confuse, like 0 and O")
+	requireEach := flags.Bool("require-each", false, "use every type of character at least once")
+	words := flags.Int("words", 0, "generate a passphrase of this many words instead")
+	wordlist := flags.String("wordlist", "large", "EFF wordlist to use, large or short")
+	separator := flags.String("separator", "-", "separator between the words of a passphrase")
+	capitalize := flags.Bool("capitalize", false, "capitalize the words of a passphrase")
+	addNumber := flags.Bool("add-number", false, "add a random digit to a word of a passphrase")
+	if flags.Parse(args[1:]) != nil {
+		return 2
+	}
+	rest := flags.Args()
+	if len(rest) < commands[args[0]] {
+		return usage()
+	}
+	parity := -1
+	for i, level := range rsLevels {
+		if level.Total()-level.Required() == *parityBytes {
+			parity = i
+		}
+	}
+	if parity < 0 {
+		return usage()
+	}
+
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "picocrypt:", err)
+		return 1
+	}
+
+	// Repairing only needs Reed-Solomon, not the password
+	if args[0] == "repair" {
+		corrected, damaged, err := repairVolume(rest[0], rest[1], bad)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("%d bytes corrected\n", corrected)
+		if damaged > 0 {
+			return fail(fmt.Errorf("%d blocks are damaged beyond repair", damaged))
+		}
+		return 0
+	}
+
+	// Splitting a new key into shares needs nothing else
+	if args[0] == "shares" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fail(err)
+		}
+		shares, err := splitKey(key, *threshold, *count)
+		if err != nil {
+			return fail(err)
+		}
+		paths, err := writeShares(rest[0], shares)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("any %d of these %d shares unlock the key:\n", *threshold, *count)
+		for _, i := range paths {
+			fmt.Println(i)
+		}
+		return 0
+	}
+
+	// Generating a password needs nothing else either
+	if args[0] == "passgen" {
+		var password string
+		var bits float64
+		if *words > 0 {
+			list := map[string]int{"large": 0, "short": 1}
+			i, ok := list[*wordlist]
+			if !ok {
+				return fail(errors.New("the wordlist must be large or short"))
+			}
+			password = genPassphrase(wordlists[i], *words, *separator, *capitalize, *addNumber)
+			bits = passphraseEntropy(len(wordlists[i]), *words, *addNumber)
+		} else {
+			g := &passwordGenerator{length: *length, noAmbiguous: *noAmbiguous, requireEach: *requireEach}
+			if *upper {
+				g.sets = append(g.sets, upperChars)
+			}
+			if *lower {
+				g.sets = append(g.sets, lowerChars)
+			}
+			if *numbers {
+				g.sets = append(g.sets, numberChars)
+			}
+			g.sets = append(g.sets, *symbols, *custom) // Empty sets are left out
+			var err error
+			password, err = g.generate()
+			if err != nil {
+				return fail(err)
+			}
+			bits = g.entropy()
+		}
+		fmt.Println(password)
+		fmt.Fprintf(os.Stderr, "%.1f bits of entropy\n", bits)
+		return 0
+	}
+
+	// Creating a managed keyfile only needs its passphrase
+	in := bufio.NewReader(os.Stdin)
+	if args[0] == "keyfile" {
+		passphrase, err := readSecret(in, "Passphrase: ")
+		if err != nil {
+			return fail(err)
+		}
+		if passphrase == "" {
+			return fail(errors.New("a passphrase is required"))
+		}
+		k, _, err := createManagedKeyfile(rest[0], *label, passphrase)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("created keyfile %s\n", k.fingerprint())
+		return 0
+	}
+
+	// Volumes and repositories that use keyfiles only don't need a password
+	password := ""
+	usingKeyfilesOnly := *keyfileOnly || usesKeyfilesOnly(rest[0])
+	if usingKeyfilesOnly {
+		if len(keyfiles) == 0 {
+			return fail(errors.New("keyfile-only mode needs keyfiles"))
+		}
+		fmt.Fprintln(os.Stderr, "Using keyfiles only, no password needed.")
+	} else {
+		var err error
+		password, err = readPassword(in, *passwordFd, *passwordEnv, *passwordFile, *passwordCommand)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	// The password of a new volume or repository must meet the policy
+	creating := args[0] == "init"
+	if _, err := os.Stat(rest[0]); args[0] == "append" && os.IsNotExist(err) {
+		creating = true
+	}
+	if creating {
+		if policyErr != nil {
+			return fail(fmt.Errorf("password policy: %w", policyErr))
+		}
+		problem := policy.checkKeyfileOnly()
+		if !usingKeyfilesOnly {
+			var err error
+			if problem, err = policy.check(password); err != nil {
+				return fail(fmt.Errorf("password policy: %w", err))
+			}
+		}
+		if problem != "" && policy.Reject {
+			return fail(errors.New(problem))
+		} else if problem != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s.\n", problem)
+		}
+	}
+
+	// Unlock managed keyfiles with their own passphrases
+	for _, path := range keyfiles {
+		k, err := readManagedKeyfile(path)
+		if err != nil {
+			return fail(&keyfileError{path, err})
+		}
+		if k == nil {
+			continue
+		}
+		passphrase, err := readSecret(in, fmt.Sprintf("Passphrase for keyfile %s (%s): ", k.Label, k.fingerprint()))
+		if err != nil {
+			return fail(err)
+		}
+		secret, err := k.unlock(passphrase)
+		if err != nil {
+			return fail(fmt.Errorf("keyfile %s: %w", path, err))
+		}
+		unlockedKeyfiles[path] = secret
+	}
+
+	switch args[0] {
+	case "init":
+		if err := initRepository(rest[0], password, keyfiles, *paranoid, *keyfileOnly); err != nil {
+			return fail(err)
+		}
+		return 0
+	case "backup", "restore", "snapshots", "prune":
+		repo, err := openRepository(rest[0], password, keyfiles)
+		if err != nil {
+			return fail(err)
+		}
+		return repositoryCommand(repo, args[0], rest[1:], *output, *keep, fail)
+	}
+
+	// Append to a volume, creating it if it doesn't exist yet
+	if args[0] == "append" {
+		var volume *volumeReader
+		created := false
+		if _, err := os.Stat(rest[0]); os.IsNotExist(err) {
+			volume, err = createVolume(rest[0], password, keyfiles, *paranoid, *reedsolo, parity, *spread, *keyfileOnly)
+			if err != nil {
+				return fail(err)
+			}
+			created = true
+		} else {
+			volume, err = openVolume(rest[0], password, keyfiles, os.O_RDWR, bad)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		err := appendGeneration(volume, rest[1:], *compress)
+		volume.Close()
+		if err != nil {
+			if created {
+				os.Remove(rest[0])
+			}
+			return fail(err)
+		}
+		return 0
+	}
+
+	volume, err := openVolume(rest[0], password, keyfiles, os.O_RDONLY, bad)
+	if err != nil {
+		return fail(err)
+	}
+	defer volume.Close()
+
+	if args[0] == "generations" {
+		_, comment, err := readZipDirectory(volume, volume.Size())
+		generations := parseGenerations(comment)
+		if err != nil || generations == nil {
+			return fail(errors.New("the volume isn't appendable"))
+		}
+		for i, g := range generations {
+			files := 0
+			selected := io.NewSectionReader(volume, 0, g.segments*int64(appendSpan))
+			if archive, err := zip.NewReader(selected, selected.Size()); err == nil {
+				files = len(archive.File)
+			}
+			fmt.Printf("%4d  %s  %d files\n", i+1, g.time.Format("2006-01-02 15:04"), files)
+		}
+		return 0
+	}
+	selected, err := snapshot(volume, *number)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Serve the contents until unmounted
+	if args[0] == "mount" {
+		name := filepath.Base(strings.TrimSuffix(strings.TrimSuffix(rest[0], "h"), ".pcv"))
+		if err := mountVolume(selected, name, rest[1]); err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+
+	// Only the zip directory and the requested entries are decrypted
+	archive, err := zip.NewReader(selected, selected.Size())
+	if err != nil {
+		return fail(errors.New("the volume doesn't contain a zip archive"))
+	}
+	if args[0] == "list" {
+		for _, f := range archive.File {
+			fmt.Printf("%10s  %s  %s\n", sizeify(int64(f.UncompressedSize64)), f.Modified.Format("2006-01-02 15:04"), f.Name)
+		}
+		return 0
+	}
+
+	for _, want := range rest[1:] {
+		want = strings.TrimSuffix(filepath.ToSlash(want), "/")
+		found := false
+		for _, f := range archive.File {
+			if f.Name != want && f.Name != want+"/" && !strings.HasPrefix(f.Name, want+"/") {
+				continue
+			}
+			found = true
+			if err := extractEntry(f, *output); err != nil {
+				return fail(err)
+			}
+		}
+		if !found {
+			return fail(fmt.Errorf("%s: no such entry in the volume", want))
+		}
+	}
+	return 0
+}
+
+// Whether a slash-separated name stays inside the folder it's extracted to
+func safeName(name string) bool {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+	for _, part := range parts {
+		if part == ".." {
+			return false
+		}
+	}
+	return !strings.HasPrefix(name, "/") && filepath.VolumeName(name) == "" && !filepath.IsAbs(filepath.FromSlash(name))
+}
+
+// Extract an entry of a zip archive into a folder
+func extractEntry(f *zip.File, folder string) error {
+	// Don't allow entries to escape the folder
+	if !safeName(f.Name) {
+		return fmt.Errorf("%s: unsafe path", f.Name)
+	}
+
+	path := filepath.Join(folder, filepath.FromSlash(f.Name))
+	if strings.HasSuffix(f.Name, "/") {
+		return os.MkdirAll(path, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fin, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	fout, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	// The checksum of the entry is verified when reaching the end
+	_, err = io.Copy(fout, fin)
+	fout.Close()
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("%s: %w", f.Name, err)
+	}
+	return nil
+}
+
+// Whether an existing volume or repository uses keyfiles only, so the
+// password isn't asked for
+func usesKeyfilesOnly(path string) bool {
+	for _, i := range []string{filepath.Join(path, "config"), path, path + "h"} {
+		fin, err := os.Open(i)
+		if err != nil {
+			continue
+		}
+		h, err := readHeader(fin)
+		fin.Close()
+		if err == nil {
+			return h.keyfileOnly()
+		}
+	}
+	return false
+}
+
+// Read the password from a file descriptor, an environment variable, a file,
+// or the first line a command prints if one of them is given, and otherwise
+// from standard input. The clipboard is never used.
+func readPassword(in *bufio.Reader, fd int, env string, file string, command string) (string, error) {
+	sources := 0
+	for _, given := range []bool{fd >= 0, env != "", file != "", command != ""} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", errors.New("give the password in only one way")
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case fd == 0:
+		return readSecret(in, "")
+	case fd > 0:
+		fin := os.NewFile(uintptr(fd), "password-fd")
+		defer fin.Close()
+		data, err = bufio.NewReader(fin).ReadBytes('\n')
+		if err == io.EOF {
+			err = nil
+		}
+	case env != "":
+		password, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("%s isn't set", env)
+		}
+		os.Unsetenv(env) // Don't pass it on to other processes
+		return password, nil
+	case file != "":
+		data, err = os.ReadFile(file)
+	case command != "":
+		shell := exec.Command("sh", "-c", command)
+		if runtime.GOOS == "windows" {
+			shell = exec.Command("cmd", "/C", command)
+		}
+		shell.Stderr = os.Stderr
+		data, err = shell.Output()
+		if err != nil {
+			err = fmt.Errorf("password command: %w", err)
+		}
+	default:
+		return readSecret(in, "Password: ")
+	}
+	if err != nil {
+		return "", err
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// Read a password or passphrase from standard input, without showing it if
+// it's typed into a terminal
+func readSecret(in *bufio.Reader, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if restore, err := hideInput(os.Stdin); err == nil {
+		defer fmt.Fprintln(os.Stderr) // The typed newline isn't shown either
+		defer restore()
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func main() {
+	// Run a command if one is given, otherwise start the GUI. Other arguments,
+	// like a file opened with Picocrypt or macOS's -psn_, just start the GUI.
+	if len(os.Args) > 1 {
+		if _, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[1:]))
+		}
+	}
+
+	// Create the main window
+	window = giu.NewMasterWindow("Picocrypt", 318, 479, giu.MasterWindowFlagsNotResizable)
+
+	// Start the dialog module
+	dialog.Init()
+
+	// Set callbacks
+	window.SetDropCallback(onDrop)
+	window.SetCloseCallback(func() bool {
+		if working || showProgress {
+			return false
+		}
+		clearClipboard() // Don't leave a copied password behind
+		return true
 	})
 
 	// Set universal DPI
@@ -0,0 +1,300 @@
+package main
+
+/*
+
+Split volumes read and written as a single file. When encrypting, writes roll
+over to the next chunk once one is full, so no full-size file is needed. When
+decrypting, reads go across the chunks directly, with missing chunks read as
+zeros so Reed-Solomon can treat them as erasures.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/HACKERALERT/crypto/sha3"
+)
+
+// A volume file, which may be split into chunks
+type volumeFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+}
+
+// The chunks of a split volume as one file
+type splitFile struct {
+	base   string
+	sizes  []int64    // Size of every chunk
+	starts []int64    // Where every chunk starts in the volume
+	files  []*os.File // Missing chunks are nil
+	offset int64      // Position for Read, Write, and Seek
+	total  int64      // Size of all chunks together
+
+	// Hashes of the chunks for the manifest, computed while writing in order.
+	// Chunks written out of order (like the header at the end) are hashed again.
+	hashes []hash.Hash
+	hashed []int64
+	dirty  []bool
+}
+
+// Set the sizes of the chunks
+func (f *splitFile) layout(sizes []int64) {
+	f.sizes, f.starts = sizes, nil
+	start := int64(0)
+	for _, i := range sizes {
+		f.starts = append(f.starts, start)
+		start += i
+	}
+}
+
+// Create the chunks of a split volume with the given sizes. If more is
+// written, the last chunk grows.
+func createSplitFile(base string, sizes []int64) (*splitFile, error) {
+	if len(sizes) == 0 {
+		return nil, errors.New("no chunks")
+	}
+	f := &splitFile{base: base}
+	f.layout(sizes)
+	if err := f.grow(0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Open the chunks of a split volume for reading. Without a manifest, the
+// chunks are found by looking for the highest chunk number, and missing
+// chunks are assumed to be as large as the largest one.
+func openSplitFile(base string, set *splitSet) (*splitFile, error) {
+	f := &splitFile{base: base}
+	if set != nil {
+		f.layout(set.sizes)
+	} else {
+		count := lastChunk(base) + 1
+		if count == 0 {
+			return nil, errors.New("no chunks found")
+		}
+		largest := int64(0)
+		sizes := make([]int64, count)
+		for i := range sizes {
+			sizes[i] = -1
+			if stat, err := os.Stat(fmt.Sprintf("%s.%d", base, i)); err == nil {
+				sizes[i] = stat.Size()
+				if stat.Size() > largest {
+					largest = stat.Size()
+				}
+			}
+		}
+		for i := range sizes {
+			if sizes[i] < 0 {
+				sizes[i] = largest
+			}
+		}
+		f.layout(sizes)
+	}
+
+	for i, size := range f.sizes {
+		fin, err := os.Open(fmt.Sprintf("%s.%d", base, i))
+		if err != nil {
+			fin = nil
+		}
+		f.files = append(f.files, fin)
+		f.total += size
+	}
+	return f, nil
+}
+
+// Size of the whole volume
+func (f *splitFile) Size() int64 {
+	return f.total
+}
+
+// Parts of the volume that are in missing or too short chunks
+func (f *splitFile) missing() badRanges {
+	var bad badRanges
+	start := int64(0)
+	for i, size := range f.sizes {
+		have := int64(0)
+		if f.files[i] != nil {
+			if stat, err := f.files[i].Stat(); err == nil {
+				have = stat.Size()
+			}
+		}
+		if have < size {
+			bad = append(bad, badRange{start + have, start + size})
+		}
+		start += size
+	}
+	return bad
+}
+
+// Find the chunk holding an offset
+func (f *splitFile) locate(offset int64) (int, int64) {
+	index := sort.Search(len(f.starts), func(i int) bool {
+		return f.starts[i] > offset
+	}) - 1
+	return index, offset - f.starts[index]
+}
+
+func (f *splitFile) ReadAt(p []byte, offset int64) (int, error) {
+	done := 0
+	for done < len(p) {
+		if offset >= f.total {
+			return done, io.EOF
+		}
+		index, local := f.locate(offset)
+		piece := p[done:]
+		if int64(len(piece)) > f.sizes[index]-local {
+			piece = piece[:f.sizes[index]-local]
+		}
+
+		// Missing parts of chunks are read as zeros
+		n := 0
+		if f.files[index] != nil {
+			var err error
+			n, err = f.files[index].ReadAt(piece, local)
+			if err != nil && err != io.EOF {
+				return done + n, err
+			}
+		}
+		for i := n; i < len(piece); i++ {
+			piece[i] = 0
+		}
+		done += len(piece)
+		offset += int64(len(piece))
+	}
+	return done, nil
+}
+
+func (f *splitFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Make sure the chunks up to the given one exist
+func (f *splitFile) grow(index int) error {
+	for len(f.files) <= index {
+		fout, err := os.Create(fmt.Sprintf("%s.%d", f.base, len(f.files)))
+		if err != nil {
+			return err
+		}
+		f.files = append(f.files, fout)
+		f.hashes = append(f.hashes, sha3.New256())
+		f.hashed = append(f.hashed, 0)
+		f.dirty = append(f.dirty, false)
+	}
+	return nil
+}
+
+func (f *splitFile) WriteAt(p []byte, offset int64) (int, error) {
+	done := 0
+	for done < len(p) {
+		index, local := f.locate(offset)
+		piece := p[done:]
+		if index < len(f.sizes)-1 && int64(len(piece)) > f.sizes[index]-local {
+			piece = piece[:f.sizes[index]-local]
+		}
+		if err := f.grow(index); err != nil {
+			return done, err
+		}
+		n, err := f.files[index].WriteAt(piece, local)
+		if local == f.hashed[index] {
+			f.hashes[index].Write(piece[:n])
+			f.hashed[index] += int64(n)
+		} else if local < f.hashed[index] {
+			f.dirty[index] = true
+		}
+		done += n
+		offset += int64(n)
+		if offset > f.total {
+			f.total = offset
+		}
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (f *splitFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *splitFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.total
+	}
+	if offset < 0 {
+		return f.offset, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *splitFile) Close() error {
+	var err error
+	for _, i := range f.files {
+		if i != nil {
+			if cerr := i.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// Describe the written chunks for the manifest, once they're closed
+func (f *splitFile) splitSet() (*splitSet, error) {
+	s := &splitSet{base: f.base, data: len(f.files)}
+	for i := range f.files {
+		stat, err := os.Stat(s.path(i))
+		if err != nil {
+			return nil, err
+		}
+		s.sizes = append(s.sizes, stat.Size())
+	}
+	for i := range f.files {
+		sum := f.hashes[i]
+		if f.dirty[i] || f.hashed[i] != s.chunkSize(i) {
+			sum = sha3.New256()
+			fin, err := os.Open(s.path(i))
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(sum, fin)
+			fin.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.hashes = append(s.hashes, sum.Sum(nil))
+	}
+	return s, nil
+}
+
+// Remove the chunks, recovery chunks, and manifest of a split volume
+func removeChunks(base string) {
+	for i := lastChunk(base); i >= 0; i-- {
+		os.Remove(fmt.Sprintf("%s.%d", base, i))
+	}
+	for i := 0; i < 256; i++ {
+		os.Remove(fmt.Sprintf("%s.p%d", base, i))
+	}
+	os.Remove(base + "m")
+}
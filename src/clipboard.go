@@ -0,0 +1,75 @@
+package main
+
+/*
+
+Copying passwords to the clipboard, which is cleared again after a timeout if
+it still holds the copied password, so a password copied earlier or something
+copied since is never erased. Only a hash of the copied password is kept to
+compare against. The timer doesn't depend on the password entries, so the
+clipboard is still cleared after the window is reset.
+
+*/
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	"github.com/HACKERALERT/clipboard"
+	"github.com/HACKERALERT/crypto/sha3"
+)
+
+// How long a copied password stays in the clipboard
+var clipboardTimeouts = []string{"Clear in 10s", "Clear in 30s", "Clear in 1 min", "Clear in 5 min", "Never clear"}
+var clipboardDelays = []time.Duration{10 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute, 0}
+var clipboardTimeout int32 = 1
+
+// The last password copied, as a SHA3-256 hash, and how many were copied so
+// that the timer of an earlier copy does nothing
+var clipboardLock sync.Mutex
+var clipboardHash []byte
+var clipboardCopies int
+
+// Copy a password to the clipboard and clear it after the selected timeout
+func copyPassword(password string) {
+	clipboardLock.Lock()
+	defer clipboardLock.Unlock()
+	clipboard.WriteAll(password)
+	clipboardCopies++
+	clipboardHash = nil
+
+	delay := clipboardDelays[clipboardTimeout]
+	if delay == 0 {
+		return
+	}
+	sum := sha3.Sum256([]byte(password))
+	clipboardHash = sum[:]
+	copied := clipboardCopies
+	time.AfterFunc(delay, func() {
+		clipboardLock.Lock()
+		defer clipboardLock.Unlock()
+		if copied == clipboardCopies {
+			clearCopied()
+		}
+	})
+}
+
+// Clear the clipboard now if it still holds the last password copied
+func clearClipboard() {
+	clipboardLock.Lock()
+	defer clipboardLock.Unlock()
+	clearCopied()
+}
+
+// Same as 'clearClipboard', with 'clipboardLock' held
+func clearCopied() {
+	if clipboardHash == nil {
+		return
+	}
+	current, err := clipboard.ReadAll()
+	sum := sha3.Sum256([]byte(current))
+	if err == nil && subtle.ConstantTimeCompare(sum[:], clipboardHash) == 1 {
+		clipboard.WriteAll("")
+	}
+	clipboardHash = nil
+}
@@ -3,6 +3,7 @@ module Picocrypt
 go 1.17
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
 	github.com/HACKERALERT/clipboard v0.1.5-0.20220507233423-cccec4a4226a
 	github.com/HACKERALERT/crypto v0.0.0-20220508005928-a6d354b4bce5
 	github.com/HACKERALERT/dialog v0.0.0-20220508022504-af3bc34fe379
@@ -11,6 +12,7 @@ require (
 	github.com/HACKERALERT/infectious v0.0.0-20220507232346-2b127b76a757
 	github.com/HACKERALERT/serpent v0.0.0-20210716182301-293b29869c66
 	github.com/HACKERALERT/zxcvbn-go v0.0.0-20220508022013-fa924b767f89
+	golang.org/x/sys v0.10.0
 )
 
 require (
@@ -0,0 +1,300 @@
+package main
+
+/*
+
+Managed keyfiles, which keep a random secret encrypted under a passphrase
+instead of being used as they are. The file starts with a line identifying
+it, followed by JSON with a label, the creation date, an ID, and the secret
+encrypted with XChaCha20 and authenticated with keyed BLAKE2b. The keys come
+from the passphrase with Argon2id, the same way as the key of a volume. Once
+unlocked, the secret is used in place of the file's contents, so a managed
+keyfile works like any other keyfile. See Internals.md for the format.
+
+Volumes also record a short, salted check of every keyfile, so that when the
+keyfiles are incorrect, Picocrypt can tell which one is wrong or missing, or
+whether they're in the wrong order.
+
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HACKERALERT/crypto/blake2b"
+	"github.com/HACKERALERT/crypto/chacha20"
+	"github.com/HACKERALERT/crypto/hkdf"
+	"github.com/HACKERALERT/crypto/sha3"
+)
+
+// Identifies a managed keyfile
+const keyfileMagic = "Picocrypt keyfile\n"
+
+// Largest managed keyfile that will be read
+const maxManagedKeyfile = 64 << 10
+
+// Secrets of the managed keyfiles that have been unlocked, by path
+var unlockedKeyfiles = map[string][]byte{}
+
+// A managed keyfile was given without being unlocked
+var errKeyfileLocked = errors.New("keyfile is locked")
+
+// A managed keyfile as stored on disk
+type managedKeyfile struct {
+	Label   string `json:"label"`
+	Created string `json:"created"` // RFC 3339, in UTC
+	ID      []byte `json:"id"`      // Identifies the secret without revealing it
+	Salt    []byte `json:"salt"`    // Argon2 salt, 16 bytes
+	Nonce   []byte `json:"nonce"`   // XChaCha20 nonce, 24 bytes
+	Secret  []byte `json:"secret"`  // The encrypted secret, 32 bytes
+	Tag     []byte `json:"tag"`     // BLAKE2b-512 of all of the above
+}
+
+// The ID of a secret, which volumes record to show which keyfile they expect
+func keyfileID(secret []byte) []byte {
+	sum := sha3.Sum256(append([]byte("Picocrypt keyfile ID"), secret...))
+	return sum[:16]
+}
+
+// Short, human-readable form of the ID
+func (k *managedKeyfile) fingerprint() string {
+	return formatFingerprint(k.ID[:8])
+}
+
+// Derive the encryption and MAC keys from the passphrase
+func (k *managedKeyfile) keys(passphrase string) ([]byte, []byte) {
+	key := deriveKey(passphrase, k.Salt, false)
+	subkeys := hkdf.New(sha3.New256, key, k.Salt, []byte(keyfileMagic))
+	encKey := make([]byte, 32)
+	macKey := make([]byte, 32)
+	subkeys.Read(encKey)
+	subkeys.Read(macKey)
+	return encKey, macKey
+}
+
+// Authenticate the metadata and encrypted secret, each prefixed with its
+// length so they can't be shifted into each other
+func (k *managedKeyfile) tag(macKey []byte) []byte {
+	mac, _ := blake2b.New512(macKey)
+	for _, i := range [][]byte{[]byte(k.Label), []byte(k.Created), k.ID, k.Salt, k.Nonce, k.Secret} {
+		binary.Write(mac, binary.BigEndian, uint64(len(i)))
+		mac.Write(i)
+	}
+	return mac.Sum(nil)
+}
+
+// Create a managed keyfile with a new secret, returning it unlocked
+func createManagedKeyfile(path string, label string, passphrase string) (*managedKeyfile, []byte, error) {
+	k := &managedKeyfile{
+		Label:   label,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Salt:    make([]byte, 16),
+		Nonce:   make([]byte, 24),
+		Secret:  make([]byte, 32),
+	}
+	secret := make([]byte, 32)
+	for _, i := range [][]byte{secret, k.Salt, k.Nonce} {
+		if _, err := rand.Read(i); err != nil {
+			return nil, nil, err
+		}
+	}
+	k.ID = keyfileID(secret)
+
+	encKey, macKey := k.keys(passphrase)
+	chacha, _ := chacha20.NewUnauthenticatedCipher(encKey, k.Nonce)
+	chacha.XORKeyStream(k.Secret, secret)
+	k.Tag = k.tag(macKey)
+
+	data, _ := json.MarshalIndent(k, "", "\t")
+	data = append([]byte(keyfileMagic), data...)
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return nil, nil, err
+	}
+	return k, secret, nil
+}
+
+// Read a managed keyfile, returning nil if the file is an ordinary keyfile
+func readManagedKeyfile(path string) (*managedKeyfile, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	magic := make([]byte, len(keyfileMagic))
+	if _, err := io.ReadFull(fin, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if string(magic) != keyfileMagic {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(fin, maxManagedKeyfile))
+	if err != nil {
+		return nil, err
+	}
+	k := &managedKeyfile{}
+	if json.Unmarshal(data, k) != nil || len(k.ID) != 16 || len(k.Salt) != 16 ||
+		len(k.Nonce) != 24 || len(k.Secret) != 32 || len(k.Tag) != 64 {
+		return nil, errors.New("damaged keyfile")
+	}
+	return k, nil
+}
+
+// Decrypt the secret of a managed keyfile
+func (k *managedKeyfile) unlock(passphrase string) ([]byte, error) {
+	encKey, macKey := k.keys(passphrase)
+	if subtle.ConstantTimeCompare(k.tag(macKey), k.Tag) == 0 {
+		return nil, errors.New("incorrect passphrase")
+	}
+	secret := make([]byte, 32)
+	chacha, _ := chacha20.NewUnauthenticatedCipher(encKey, k.Nonce)
+	chacha.XORKeyStream(secret, k.Secret)
+	if !bytes.Equal(keyfileID(secret), k.ID) {
+		return nil, errors.New("damaged keyfile")
+	}
+	return secret, nil
+}
+
+// Derive the key from the keyfile key alone with HKDF-SHA3, in place of
+// Argon2, since there is no password to strengthen
+func keyfileOnlyKey(keyfileKey []byte, salt []byte) []byte {
+	key := make([]byte, 32)
+	hkdf.New(sha3.New256, keyfileKey, salt, []byte("Picocrypt keyfile-only key")).Read(key)
+	return key
+}
+
+// The IDs of the unlocked managed keyfiles among the given keyfiles
+func managedKeyfileIDs(paths []string) [][]byte {
+	var ids [][]byte
+	for _, path := range paths {
+		if secret, ok := unlockedKeyfiles[path]; ok && len(ids) < 255 {
+			ids = append(ids, keyfileID(secret))
+		}
+	}
+	return ids
+}
+
+// Fingerprints of the managed keyfiles a volume expects
+func expectedKeyfiles(h *header) []string {
+	var expected []string
+	for _, i := range h.keyfileIDs {
+		expected = append(expected, formatFingerprint(i[:8]))
+	}
+	return expected
+}
+
+// The check of a keyfile, salted so it reveals nothing about the keyfile key
+func keyfileCheck(salt []byte, sum []byte) []byte {
+	check := sha3.Sum256(append(append([]byte{}, salt...), sum...))
+	return check[:5]
+}
+
+// Make room in a new header for the checks of the given keyfiles, and record
+// how many shares are needed if any of them are shares
+func (h *header) prepareKeyfileChecks(paths []string) {
+	count, threshold, shares := shareLayout(paths)
+	h.extFlags[7] = byte(threshold)
+	h.extFlags[8] = byte(shares)
+	if count == 0 || count > 255 {
+		return
+	}
+	h.extFlags[6] = byte(count)
+	h.keyfileSalt = make([]byte, 16)
+	rand.Read(h.keyfileSalt)
+	h.keyfileChecks = make([][]byte, count)
+	for i := range h.keyfileChecks {
+		h.keyfileChecks[i] = make([]byte, 5)
+	}
+}
+
+// Fill in the keyfile checks from the SHA3-256 of every keyfile
+func (h *header) recordKeyfileChecks(sums [][]byte) {
+	if len(sums) != len(h.keyfileChecks) {
+		return
+	}
+	for i, sum := range sums {
+		h.keyfileChecks[i] = keyfileCheck(h.keyfileSalt, sum)
+	}
+}
+
+// Find out what's wrong with incorrect keyfiles using the keyfile checks,
+// returning an empty string if it can't be told
+func keyfileProblem(h *header, sums [][]byte, ordered bool) string {
+	expected := len(h.keyfileChecks)
+	if expected == 0 {
+		return ""
+	}
+
+	// Match every keyfile given to an expected one
+	used := make([]bool, expected)
+	var wrong []string
+	var order []int
+	for i, sum := range sums {
+		check := keyfileCheck(h.keyfileSalt, sum)
+		found := -1
+		for j := range h.keyfileChecks {
+			if !used[j] && bytes.Equal(check, h.keyfileChecks[j]) {
+				found = j
+				break
+			}
+		}
+		if found < 0 {
+			wrong = append(wrong, strconv.Itoa(i+1))
+			continue
+		}
+		used[found] = true
+		order = append(order, found)
+	}
+
+	var problem string
+	switch {
+	case len(wrong) == 1:
+		problem = fmt.Sprintf("keyfile %s of %d is wrong", wrong[0], len(sums))
+	case len(wrong) > 1:
+		problem = fmt.Sprintf("keyfiles %s of %d are wrong", strings.Join(wrong, ", "), len(sums))
+	case len(sums) < expected:
+		return fmt.Sprintf("%d of %d keyfiles are missing", expected-len(sums), expected)
+	case ordered && !sort.IntsAreSorted(order):
+		return "the keyfiles are in the wrong order"
+	default:
+		return ""
+	}
+	if len(sums) != expected {
+		problem += fmt.Sprintf(" (%s)", expectedCount(expected))
+	}
+	return problem
+}
+
+// Describe how many keyfiles a volume expects
+func expectedCount(count int) string {
+	if count == 1 {
+		return "the volume expects 1 keyfile"
+	}
+	return fmt.Sprintf("the volume expects %d keyfiles", count)
+}
+
+// Report incorrect keyfiles, saying what's wrong if the keyfile checks can
+// tell, and naming the managed keyfiles that were expected
+func incorrectKeyfiles(h *header, sums [][]byte, ordered bool) error {
+	problem := keyfileProblem(h, sums, ordered)
+	if problem == "" {
+		problem = "incorrect keyfiles"
+	}
+	if expected := expectedKeyfiles(h); len(expected) > 0 {
+		return fmt.Errorf("%s (expected %s)", problem, strings.Join(expected, ", "))
+	}
+	return errors.New(problem)
+}
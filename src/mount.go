@@ -0,0 +1,241 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+/*
+
+Mounting of volumes as read-only filesystems through FUSE. Everything is
+decrypted and verified on demand by a volumeReader, and nothing is written to
+disk. A volume containing a zip archive shows the archive's contents, any
+other volume shows a single file.
+
+*/
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// The filesystem of a mounted volume
+type mountFS struct {
+	root *mountDir
+}
+
+// A folder, either inside the archive or the root of the filesystem
+type mountDir struct {
+	entries  map[string]fs.Node
+	modified time.Time
+}
+
+// A file, either an entry of the archive or the whole volume
+type mountFile struct {
+	volume   contents
+	entry    *zip.File // Nil if the volume isn't an archive
+	modified time.Time
+}
+
+// An open file, keeping the position of compressed entries so sequential
+// reads don't decompress everything before them again
+type mountHandle struct {
+	file   *mountFile
+	mutex  sync.Mutex
+	reader io.ReadCloser
+	pos    int64
+}
+
+// Mount the contents of a volume until the filesystem is unmounted or the
+// process is interrupted
+func mountVolume(volume contents, name string, mountpoint string) error {
+	root := mountTree(volume, name)
+	conn, err := fuse.Mount(
+		mountpoint,
+		fuse.ReadOnly(),
+		fuse.FSName("picocrypt"),
+		fuse.Subtype("picocrypt"),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unmount cleanly when interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			fuse.Unmount(mountpoint)
+		}
+	}()
+
+	err = fs.Serve(conn, mountFS{root})
+	if err != nil {
+		return err
+	}
+	<-conn.Ready
+	return conn.MountError
+}
+
+// Build the folder tree of a volume
+func mountTree(volume contents, name string) *mountDir {
+	root := &mountDir{entries: map[string]fs.Node{}, modified: time.Now()}
+	archive, err := zip.NewReader(volume, volume.Size())
+	if err != nil {
+		root.entries[name] = &mountFile{volume: volume, modified: root.modified}
+		return root
+	}
+
+	for _, f := range archive.File {
+		parts := strings.Split(strings.TrimSuffix(f.Name, "/"), "/")
+		dir := root
+		for i, part := range parts {
+			// Skip anything that can't be represented safely
+			if part == "" || part == "." || part == ".." {
+				break
+			}
+			if i == len(parts)-1 && !strings.HasSuffix(f.Name, "/") {
+				dir.entries[part] = &mountFile{volume: volume, entry: f, modified: f.Modified}
+				break
+			}
+			sub, ok := dir.entries[part].(*mountDir)
+			if !ok {
+				sub = &mountDir{entries: map[string]fs.Node{}, modified: f.Modified}
+				dir.entries[part] = sub
+			}
+			dir = sub
+		}
+	}
+	return root
+}
+
+func (m mountFS) Root() (fs.Node, error) {
+	return m.root, nil
+}
+
+func (d *mountDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0555
+	attr.Mtime = d.modified
+	return nil
+}
+
+func (d *mountDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if node, ok := d.entries[name]; ok {
+		return node, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *mountDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	for name, node := range d.entries {
+		kind := fuse.DT_File
+		if _, ok := node.(*mountDir); ok {
+			kind = fuse.DT_Dir
+		}
+		entries = append(entries, fuse.Dirent{Name: name, Type: kind})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+func (f *mountFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = 0444
+	attr.Mtime = f.modified
+	if f.entry == nil {
+		attr.Size = uint64(f.volume.Size())
+	} else {
+		attr.Size = f.entry.UncompressedSize64
+	}
+	return nil
+}
+
+func (f *mountFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	return &mountHandle{file: f}, nil
+}
+
+func (h *mountHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.readAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return fuse.EIO
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Read the contents of the file at an offset
+func (h *mountHandle) readAt(buf []byte, off int64) (int, error) {
+	f := h.file
+	if f.entry == nil {
+		return f.volume.ReadAt(buf, off)
+	}
+
+	// Stored entries can be read directly from the volume
+	if f.entry.Method == zip.Store {
+		start, err := f.entry.DataOffset()
+		if err != nil {
+			return 0, err
+		}
+		size := int64(f.entry.UncompressedSize64)
+		if off >= size {
+			return 0, io.EOF
+		}
+		if int64(len(buf)) > size-off {
+			buf = buf[:size-off]
+		}
+		return f.volume.ReadAt(buf, start+off)
+	}
+
+	// Compressed entries have to be decompressed from the start
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.reader == nil || off < h.pos {
+		if h.reader != nil {
+			h.reader.Close()
+		}
+		reader, err := f.entry.Open()
+		if err != nil {
+			return 0, err
+		}
+		h.reader, h.pos = reader, 0
+	}
+	if off > h.pos {
+		skipped, err := io.CopyN(io.Discard, h.reader, off-h.pos)
+		h.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(h.reader, buf)
+	h.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (h *mountHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.reader != nil {
+		h.reader.Close()
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "errors"
+
+// Mounting needs FUSE, which isn't available on this platform
+func mountVolume(volume contents, name string, mountpoint string) error {
+	return errors.New("mounting isn't supported on this platform")
+}
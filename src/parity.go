@@ -0,0 +1,448 @@
+package main
+
+/*
+
+Manifests and recovery chunks for split volumes. The manifest (.pcvm) lists
+the number, sizes, and hashes of the chunks, so missing or damaged chunks are
+found before decrypting. Besides the data chunks (.0, .1, ...), a split volume
+can have recovery chunks (.p0, .p1, ...) holding Reed-Solomon parity computed
+across the data chunks, so any of them can be rebuilt as long as no more
+chunks are missing or damaged than there are recovery chunks. Recovery chunks
+start with a copy of the manifest. See Internals.md for the format.
+
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/HACKERALERT/crypto/sha3"
+	"github.com/HACKERALERT/infectious"
+)
+
+// Identify a manifest and a recovery chunk
+const manifestMagic = "Picocrypt chunks"
+const recoveryMagic = "Picocrypt parity"
+
+// How much of every chunk is processed at once
+const recoveryStripe = 64 << 10
+
+// Most data chunks a manifest can describe
+const maxChunks = 1 << 20
+
+// Most data and recovery chunks together, since Reed-Solomon works on bytes
+const maxRecoverySet = 256
+
+// The chunks of a split volume, as described by its recovery chunks
+type splitSet struct {
+	base     string   // Path of the volume without the chunk number
+	data     int      // Number of data chunks
+	recovery int      // Number of recovery chunks
+	sizes    []int64  // Sizes of the data chunks
+	hashes   [][]byte // SHA3-256 of the data chunks, then of the recovery chunks' parity
+}
+
+// Path of a data chunk, or of a recovery chunk after the data chunks
+func (s *splitSet) path(index int) string {
+	if index < s.data {
+		return fmt.Sprintf("%s.%d", s.base, index)
+	}
+	return fmt.Sprintf("%s.p%d", s.base, index-s.data)
+}
+
+// Size of a chunk's contents (the parity in recovery chunks is as large as
+// the largest data chunk)
+func (s *splitSet) chunkSize(index int) int64 {
+	if index < s.data {
+		return s.sizes[index]
+	}
+	return s.largest()
+}
+
+// Size of the largest data chunk
+func (s *splitSet) largest() int64 {
+	largest := int64(0)
+	for _, i := range s.sizes {
+		if i > largest {
+			largest = i
+		}
+	}
+	return largest
+}
+
+// Where the contents of a chunk start (after the description in recovery chunks)
+func (s *splitSet) start(index int) int64 {
+	if index < s.data {
+		return 0
+	}
+	return int64(32 + 8*s.data + 32*(s.data+s.recovery) + 32)
+}
+
+// Encode the manifest, or the description stored at the start of a recovery chunk
+func (s *splitSet) describe(magic string, index int) []byte {
+	data := make([]byte, 32, s.start(s.data))
+	copy(data, magic)
+	binary.BigEndian.PutUint32(data[16:], uint32(index))
+	binary.BigEndian.PutUint32(data[20:], uint32(s.data))
+	binary.BigEndian.PutUint32(data[24:], uint32(s.recovery))
+	for _, i := range s.sizes {
+		tmp := make([]byte, 8)
+		binary.BigEndian.PutUint64(tmp, uint64(i))
+		data = append(data, tmp...)
+	}
+	for _, i := range s.hashes {
+		data = append(data, i...)
+	}
+	tmp := sha3.New256()
+	tmp.Write(data)
+	return tmp.Sum(data)
+}
+
+// Read the description of a split volume from its manifest, or from the
+// first intact recovery chunk if the manifest is missing or damaged
+func readSplitSet(base string) (*splitSet, error) {
+	if fin, err := os.Open(base + "m"); err == nil {
+		s, err := parseSplitSet(base, fin, manifestMagic)
+		fin.Close()
+		if err == nil {
+			return s, nil
+		}
+	}
+	for i := 0; i < 256; i++ {
+		fin, err := os.Open(fmt.Sprintf("%s.p%d", base, i))
+		if err != nil {
+			continue
+		}
+		s, err := parseSplitSet(base, fin, recoveryMagic)
+		fin.Close()
+		if err == nil {
+			return s, nil
+		}
+	}
+	return nil, errors.New("no intact manifest or recovery chunks")
+}
+
+// Parse and check a manifest or the description at the start of a recovery chunk
+func parseSplitSet(base string, fin io.Reader, magic string) (*splitSet, error) {
+	fixed := make([]byte, 32)
+	if _, err := io.ReadFull(fin, fixed); err != nil || string(fixed[:16]) != magic {
+		return nil, errors.New("not a manifest or recovery chunk")
+	}
+	s := &splitSet{
+		base:     base,
+		data:     int(binary.BigEndian.Uint32(fixed[20:])),
+		recovery: int(binary.BigEndian.Uint32(fixed[24:])),
+	}
+	if s.data == 0 || s.data > maxChunks || (s.recovery == 0 && magic == recoveryMagic) {
+		return nil, errors.New("the description is damaged")
+	}
+	if s.recovery > 0 && s.data+s.recovery > 256 {
+		return nil, errors.New("the description is damaged")
+	}
+	rest := make([]byte, s.start(s.data)-32)
+	if _, err := io.ReadFull(fin, rest); err != nil {
+		return nil, errors.New("the description is damaged")
+	}
+	for i := 0; i < s.data; i++ {
+		s.sizes = append(s.sizes, int64(binary.BigEndian.Uint64(rest[i*8:])))
+	}
+	hashes := rest[8*s.data:]
+	for i := 0; i < s.data+s.recovery; i++ {
+		s.hashes = append(s.hashes, hashes[i*32:(i+1)*32])
+	}
+	if !bytes.Equal(s.describe(magic, int(binary.BigEndian.Uint32(fixed[16:]))), append(fixed, rest...)) {
+		return nil, errors.New("the description is damaged")
+	}
+	return s, nil
+}
+
+// Add recovery chunks to the data chunks of a split volume. The set must
+// already have the sizes and hashes of the data chunks.
+func (s *splitSet) writeRecoveryChunks(recovery int) (err error) {
+	if s.data+recovery > maxRecoverySet {
+		return errors.New("too many chunks for recovery chunks (at most 256 together)")
+	}
+	s.recovery = recovery
+	files := make([]*os.File, s.data+recovery)
+	defer func() {
+		for i, file := range files {
+			if file == nil {
+				continue
+			}
+			file.Close()
+			if err != nil && i >= s.data {
+				os.Remove(s.path(i))
+			}
+		}
+		if err != nil {
+			s.recovery = 0
+			s.hashes = s.hashes[:s.data]
+		}
+	}()
+	for i := range files {
+		if i < s.data {
+			files[i], err = os.Open(s.path(i))
+		} else {
+			files[i], err = os.Create(s.path(i))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Compute the parity one stripe of every chunk at a time
+	fec, err := infectious.NewFEC(s.data, s.data+recovery)
+	if err != nil {
+		return err
+	}
+	hashes := make([]hash.Hash, recovery)
+	for i := range hashes {
+		hashes[i] = sha3.New256()
+	}
+	start := s.start(s.data)
+	largest := s.largest()
+	for offset := int64(0); offset < largest; offset += recoveryStripe {
+		width := int64(recoveryStripe)
+		if offset+width > largest {
+			width = largest - offset
+		}
+		stripe := make([]byte, int64(s.data)*width)
+		for i := 0; i < s.data; i++ {
+			piece := stripe[int64(i)*width : int64(i+1)*width]
+			if _, err := files[i].ReadAt(piece, offset); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		var writeErr error
+		err = fec.Encode(stripe, func(share infectious.Share) {
+			if share.Number < s.data || writeErr != nil {
+				return
+			}
+			hashes[share.Number-s.data].Write(share.Data)
+			_, writeErr = files[share.Number].WriteAt(share.Data, start+offset)
+		})
+		if err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+
+	// The description goes at the start of every recovery chunk
+	for _, i := range hashes {
+		s.hashes = append(s.hashes, i.Sum(nil))
+	}
+	for i := s.data; i < s.data+recovery; i++ {
+		if _, err := files[i].WriteAt(s.describe(recoveryMagic, i), 0); err != nil {
+			return err
+		}
+		if err := files[i].Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the manifest next to the chunks
+func (s *splitSet) writeManifest() error {
+	if s.data > maxChunks {
+		return errors.New("too many chunks for a manifest")
+	}
+	return os.WriteFile(s.base+"m", s.describe(manifestMagic, 0), 0644)
+}
+
+// Describe which data chunks are missing or damaged, and whether the only
+// problem is damage to the first chunk (which may just be in the header)
+func (s *splitSet) problem(bad []int) (string, bool) {
+	var missing, damaged []string
+	for _, i := range bad {
+		if i >= s.data {
+			continue
+		}
+		if _, err := os.Stat(s.path(i)); err != nil {
+			missing = append(missing, fmt.Sprint(i))
+		} else {
+			damaged = append(damaged, fmt.Sprint(i))
+		}
+	}
+	var problems []string
+	if len(missing) == 1 {
+		problems = append(problems, "chunk "+missing[0]+" is missing")
+	} else if len(missing) > 1 {
+		problems = append(problems, "chunks "+strings.Join(missing, ", ")+" are missing")
+	}
+	if len(damaged) == 1 {
+		problems = append(problems, "chunk "+damaged[0]+" is damaged")
+	} else if len(damaged) > 1 {
+		problems = append(problems, "chunks "+strings.Join(damaged, ", ")+" are damaged")
+	}
+	if len(problems) == 0 {
+		return "", false
+	}
+	message := strings.Join(problems, " and ") + "."
+	header := len(missing) == 0 && len(damaged) == 1 && damaged[0] == "0"
+	return strings.ToUpper(message[:1]) + message[1:], header
+}
+
+// Find the chunks that are missing or damaged
+func (s *splitSet) check() []int {
+	var bad []int
+	for i := 0; i < s.data+s.recovery; i++ {
+		if !s.intact(i, s.path(i)) {
+			bad = append(bad, i)
+		}
+	}
+	return bad
+}
+
+// Whether a file has the size and SHA3-256 recorded for a chunk
+func (s *splitSet) intact(index int, path string) bool {
+	fin, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fin.Close()
+	tmp := sha3.New256()
+	fin.Seek(s.start(index), 0)
+	n, err := io.Copy(tmp, fin)
+	return err == nil && n == s.chunkSize(index) && bytes.Equal(tmp.Sum(nil), s.hashes[index])
+}
+
+// Rebuild parts of the given data chunks from the intact chunks
+func (s *splitSet) recover(bad []int, offset int64, width int64) (map[int][]byte, error) {
+	isBad := map[int]bool{}
+	for _, i := range bad {
+		isBad[i] = true
+	}
+	var shares []infectious.Share
+	for i := 0; i < s.data+s.recovery && len(shares) < s.data; i++ {
+		if isBad[i] {
+			continue
+		}
+		fin, err := os.Open(s.path(i))
+		if err != nil {
+			return nil, err
+		}
+		piece := make([]byte, width)
+		_, err = fin.ReadAt(piece, s.start(i)+offset)
+		fin.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		shares = append(shares, infectious.Share{Number: i, Data: piece})
+	}
+	if len(shares) < s.data {
+		return nil, errors.New("too many chunks are missing or damaged to recover")
+	}
+
+	fec, err := infectious.NewFEC(s.data, s.data+s.recovery)
+	if err != nil {
+		return nil, err
+	}
+	pieces := map[int][]byte{}
+	err = fec.Rebuild(shares, func(share infectious.Share) {
+		if isBad[share.Number] {
+			pieces[share.Number] = append([]byte{}, share.Data...)
+		}
+	})
+	return pieces, err
+}
+
+// Rebuild the given chunks in place. Damaged recovery chunks are left alone,
+// since only the data chunks are needed.
+func (s *splitSet) rebuild(bad []int) (err error) {
+	if s.data+s.recovery-len(bad) < s.data {
+		return errors.New("too many chunks are missing or damaged to recover")
+	}
+
+	// Rebuilt chunks only replace the damaged ones once they're complete
+	// and match their hashes
+	files := map[int]*os.File{}
+	defer func() {
+		for i, file := range files {
+			if cerr := file.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+			if err == nil && !s.intact(i, s.path(i)+".tmp") {
+				err = fmt.Errorf("rebuilt chunk %d doesn't match its hash", i)
+			}
+		}
+		for i := range files {
+			if err == nil {
+				err = os.Rename(s.path(i)+".tmp", s.path(i))
+			} else {
+				os.Remove(s.path(i) + ".tmp")
+			}
+		}
+	}()
+	var data []int
+	for _, i := range bad {
+		if i >= s.data {
+			continue
+		}
+		fout, err := os.Create(s.path(i) + ".tmp")
+		if err != nil {
+			return err
+		}
+		files[i] = fout
+		data = append(data, i)
+	}
+
+	largest := s.largest()
+	for offset := int64(0); offset < largest; offset += recoveryStripe {
+		width := int64(recoveryStripe)
+		if offset+width > largest {
+			width = largest - offset
+		}
+		pieces, err := s.recover(bad, offset, width)
+		if err != nil {
+			return err
+		}
+		for _, i := range data {
+			piece := pieces[i]
+			if offset >= s.chunkSize(i) {
+				continue
+			}
+			if offset+width > s.chunkSize(i) {
+				piece = piece[:s.chunkSize(i)-offset]
+			}
+			if _, err := files[i].WriteAt(piece, offset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Rebuild the start of a missing first chunk, which is enough to read the header
+func splitHead(base string) ([]byte, error) {
+	s, err := readSplitSet(base)
+	if err != nil {
+		return nil, err
+	}
+	var bad []int
+	for i := 0; i < s.data+s.recovery; i++ {
+		if _, err := os.Stat(s.path(i)); err != nil {
+			bad = append(bad, i)
+		}
+	}
+	width := s.largest()
+	if width > int64(MiB) {
+		width = int64(MiB)
+	}
+	pieces, err := s.recover(bad, 0, width)
+	if err != nil {
+		return nil, err
+	}
+	if pieces[0] == nil {
+		return nil, errors.New("the first chunk isn't missing")
+	}
+	return pieces[0], nil
+}
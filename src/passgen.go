@@ -0,0 +1,150 @@
+package main
+
+/*
+
+Password generator, which picks characters at random from the selected
+character sets. Repeated characters are removed from the sets first so that
+every character is equally likely. Requiring every set is done by generating
+passwords until one contains them all, which keeps all such passwords equally
+likely. The entropy is counted exactly: when every set is required, the number
+of possible passwords comes from inclusion-exclusion over the sets.
+
+*/
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// The built-in character sets
+const upperChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+const lowerChars = "abcdefghijklmnopqrstuvwxyz"
+const numberChars = "1234567890"
+const symbolChars = "-=_+!@#$^&()?<>"
+
+// Characters that are easy to confuse with each other
+const ambiguousChars = "0O1lI|"
+
+// Settings of the password generator
+type passwordGenerator struct {
+	length      int
+	sets        []string // Character sets to pick from
+	noAmbiguous bool     // Leave out characters that are easy to confuse
+	requireEach bool     // Use every set at least once
+}
+
+// The sets to pick from without ambiguous or repeated characters, leaving
+// out the sets that end up empty
+func (g *passwordGenerator) charsets() [][]rune {
+	seen := map[rune]bool{}
+	var sets [][]rune
+	for _, set := range g.sets {
+		var chars []rune
+		for _, c := range set {
+			if seen[c] || (g.noAmbiguous && strings.ContainsRune(ambiguousChars, c)) {
+				continue
+			}
+			seen[c] = true
+			chars = append(chars, c)
+		}
+		if len(chars) > 0 {
+			sets = append(sets, chars)
+		}
+	}
+	return sets
+}
+
+// Check that passwords can be generated with these settings
+func (g *passwordGenerator) check() error {
+	sets := g.charsets()
+	if len(sets) == 0 {
+		return errors.New("no characters to choose from")
+	}
+	if g.length < 1 {
+		return errors.New("invalid length")
+	}
+	if g.requireEach && g.length < len(sets) {
+		return errors.New("too short to include every character set")
+	}
+	return nil
+}
+
+// Generate a cryptographically secure password
+func (g *passwordGenerator) generate() (string, error) {
+	if err := g.check(); err != nil {
+		return "", err
+	}
+	sets := g.charsets()
+	var chars []rune
+	for _, set := range sets {
+		chars = append(chars, set...)
+	}
+
+	password := make([]rune, g.length)
+	for {
+		for i := range password {
+			password[i] = chars[randomInt(len(chars))]
+		}
+		if !g.requireEach || usesEverySet(password, sets) {
+			return string(password), nil
+		}
+	}
+}
+
+// Whether a password has a character of every set
+func usesEverySet(password []rune, sets [][]rune) bool {
+	for _, set := range sets {
+		found := false
+		for _, c := range password {
+			found = found || strings.ContainsRune(string(set), c)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Entropy of the generated passwords in bits, which is the log2 of how many
+// different passwords can be generated
+func (g *passwordGenerator) entropy() float64 {
+	if g.check() != nil {
+		return 0
+	}
+	sets := g.charsets()
+	total := 0
+	for _, set := range sets {
+		total += len(set)
+	}
+	if !g.requireEach {
+		return float64(g.length) * math.Log2(float64(total))
+	}
+
+	// Add and subtract the passwords missing every combination of sets
+	count := new(big.Int)
+	for missing := 0; missing < 1<<len(sets); missing++ {
+		left, negative := total, false
+		for i, set := range sets {
+			if missing&(1<<i) != 0 {
+				left -= len(set)
+				negative = !negative
+			}
+		}
+		term := new(big.Int).Exp(big.NewInt(int64(left)), big.NewInt(int64(g.length)), nil)
+		if negative {
+			count.Sub(count, term)
+		} else {
+			count.Add(count, term)
+		}
+	}
+
+	// Take the log2 of the top 53 bits, which a float64 holds exactly
+	shift := count.BitLen() - 53
+	if shift < 0 {
+		shift = 0
+	}
+	top := new(big.Int).Rsh(count, uint(shift))
+	return math.Log2(float64(top.Int64())) + float64(shift)
+}
@@ -0,0 +1,72 @@
+package main
+
+/*
+
+Passphrase generator, which picks words at random from the EFF's wordlists
+so that generated passwords can be memorized. The lists are bundled in the
+EFF's own format, one dice roll and word per line. Every word of the large
+list adds log2(7776) ≈ 12.9 bits and every word of the short list adds
+log2(1296) ≈ 10.3 bits. See https://www.eff.org/dice for more about them.
+
+*/
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//go:embed wordlists/eff_large_wordlist.txt
+var effLargeWordlist string
+
+//go:embed wordlists/eff_short_wordlist_2_0.txt
+var effShortWordlist string
+
+// The words of every wordlist, in the order of 'passgenWordlists'
+var wordlists = [][]string{parseWordlist(effLargeWordlist), parseWordlist(effShortWordlist)}
+
+// Read a wordlist in the EFF's format
+func parseWordlist(data string) []string {
+	var words []string
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.Fields(line)
+		words = append(words, fields[len(fields)-1])
+	}
+	return words
+}
+
+// A cryptographically secure random number from 0 up to n
+func randomInt(n int) int {
+	i, _ := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	return int(i.Int64())
+}
+
+// Generate a passphrase of random words, optionally capitalized and with a
+// random digit added to the end of a random word
+func genPassphrase(words []string, count int, separator string, capitalize bool, number bool) string {
+	picked := make([]string, count)
+	for i := range picked {
+		picked[i] = words[randomInt(len(words))]
+		if capitalize {
+			picked[i] = strings.ToUpper(picked[i][:1]) + picked[i][1:]
+		}
+	}
+	if number {
+		i := randomInt(count)
+		picked[i] += strconv.Itoa(randomInt(10))
+	}
+	return strings.Join(picked, separator)
+}
+
+// Entropy of a generated passphrase in bits. Capitalizing every word adds
+// nothing, while the digit adds its value and which word it was added to.
+func passphraseEntropy(words int, count int, number bool) float64 {
+	bits := float64(count) * math.Log2(float64(words))
+	if number {
+		bits += math.Log2(float64(10 * count))
+	}
+	return bits
+}
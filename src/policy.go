@@ -0,0 +1,144 @@
+package main
+
+/*
+
+Password policy, which administrators can set in a configuration file to hold
+the passwords of new volumes to a minimum zxcvbn score, a minimum length, and
+a local list of breached passwords. Passwords that don't meet the policy only
+cause a warning, unless the policy rejects them. The same goes for volumes
+that use keyfiles only, unless the policy allows them. Only new volumes are checked,
+so existing volumes can always be decrypted. See README.md for the format.
+
+*/
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/HACKERALERT/zxcvbn-go"
+)
+
+// A password policy as stored in policy.json
+type passwordPolicy struct {
+	MinScore    int    `json:"minScore"`    // Minimum zxcvbn score, from 0 to 4
+	MinLength   int    `json:"minLength"`   // Minimum length in characters
+	Breached    string `json:"breached"`    // List of breached passwords, relative to policy.json
+	Reject      bool   `json:"reject"`      // Reject passwords that don't meet the policy
+	KeyfileOnly bool   `json:"keyfileOnly"` // Allow volumes without a password, that use keyfiles only
+}
+
+// The policy in effect, and why it couldn't be read if it exists but is invalid
+var policy, policyErr = loadPolicy(policyPaths())
+
+// Where to look for the policy: the system-wide location first, then next to
+// the executable for portable installs
+func policyPaths() []string {
+	var paths []string
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			paths = append(paths, filepath.Join(dir, "Picocrypt", "policy.json"))
+		}
+	case "darwin":
+		paths = append(paths, "/Library/Application Support/Picocrypt/policy.json")
+	default:
+		paths = append(paths, "/etc/picocrypt/policy.json")
+	}
+	if exe, err := os.Executable(); err == nil {
+		paths = append(paths, filepath.Join(filepath.Dir(exe), "policy.json"))
+	}
+	return paths
+}
+
+// Read the policy from the first of the given files that exists, returning an
+// empty policy if there is none
+func loadPolicy(paths []string) (*passwordPolicy, error) {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return &passwordPolicy{}, err
+		}
+		p := &passwordPolicy{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return &passwordPolicy{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if p.Breached != "" && !filepath.IsAbs(p.Breached) {
+			p.Breached = filepath.Join(filepath.Dir(path), p.Breached)
+		}
+		return p, nil
+	}
+	return &passwordPolicy{}, nil
+}
+
+// Check the password of a new volume against the policy, returning what's
+// wrong with it or an empty string if nothing is
+func (p *passwordPolicy) check(password string) (string, error) {
+	var problems []string
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("is shorter than %d characters", p.MinLength))
+	}
+	if p.MinScore > 0 {
+		if score := zxcvbn.PasswordStrength(password, nil).Score; score < p.MinScore {
+			problems = append(problems, fmt.Sprintf("is too weak (strength %d of 4, %d required)", score, p.MinScore))
+		}
+	}
+	if p.Breached != "" {
+		breached, err := isBreached(p.Breached, password)
+		if err != nil {
+			return "", err
+		}
+		if breached {
+			problems = append(problems, "is in the list of breached passwords")
+		}
+	}
+	if len(problems) == 0 {
+		return "", nil
+	}
+	return "the password " + strings.Join(problems, " and "), nil
+}
+
+// Check a new volume that uses keyfiles only, which has no password to hold
+// to the policy. Unless the policy allows them, they don't meet any policy that
+// sets requirements for passwords.
+func (p *passwordPolicy) checkKeyfileOnly() string {
+	if p.KeyfileOnly || (p.MinScore == 0 && p.MinLength == 0 && p.Breached == "") {
+		return ""
+	}
+	return "the password policy doesn't allow using keyfiles only"
+}
+
+// Look for a password in a list of breached passwords, one per line, given
+// either as they are or as SHA-1 hashes in hex, optionally followed by a colon
+// and a count like the lists of Have I Been Pwned. The list is read as a
+// stream, so it can be larger than memory.
+func isBreached(path string, password string) (bool, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fin.Close()
+
+	sum := sha1.Sum([]byte(password))
+	hash := hex.EncodeToString(sum[:])
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == password {
+			return true, nil
+		}
+		if len(line) >= 40 && strings.EqualFold(line[:40], hash) && (len(line) == 40 || line[40] == ':') {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
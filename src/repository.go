@@ -0,0 +1,568 @@
+package main
+
+/*
+
+Repositories of deduplicated, encrypted chunks. Files are split into chunks
+with content-defined chunking, so unchanged data produces the same chunks no
+matter where it moved within a file. Each unique chunk is stored once, named by
+its keyed hash, and snapshots list the chunks of every file they contain.
+See Internals.md for the format.
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HACKERALERT/crypto/blake2b"
+	"github.com/HACKERALERT/crypto/chacha20"
+	"github.com/HACKERALERT/crypto/hkdf"
+	"github.com/HACKERALERT/crypto/sha3"
+	"github.com/HACKERALERT/serpent"
+)
+
+// Chunk sizes for content-defined chunking (the average is 1 MiB)
+const minChunk = 256 << 10
+const maxChunk = 4 << 20
+const chunkMask = (1<<20 - 1) << 44 // The top bits depend on the last 64 bytes
+
+// An unlocked repository
+type repository struct {
+	path     string
+	paranoid bool
+	idKey    []byte       // Keys the hashes naming chunks
+	key      []byte       // XChaCha20 key for chunks and snapshots
+	macKey   []byte       // BLAKE2b/HMAC-SHA3 key for chunks and snapshots
+	serpent  cipher.Block // Only used in paranoid mode
+	gear     [256]uint64  // Random values for the rolling hash of the chunker
+}
+
+// The contents of a snapshot
+type snapshotIndex struct {
+	Time  time.Time
+	Files []snapshotFile
+}
+
+// A file in a snapshot
+type snapshotFile struct {
+	Name     string // Slash-separated, relative to the parent of what was backed up
+	Mode     os.FileMode
+	Modified time.Time
+	Size     int64
+	Chunks   []string
+}
+
+// Create a new repository in an empty or nonexistent folder
+func initRepository(path string, password string, keyfiles []string, paranoid bool, keyfileOnly bool) error {
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		return errors.New("the folder isn't empty")
+	}
+	for _, dir := range []string{path, filepath.Join(path, "chunks"), filepath.Join(path, "snapshots")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	// The configuration is a volume header without contents
+	flags := make([]byte, 5)
+	if paranoid {
+		flags[0] = 1
+	}
+	if len(keyfiles) > 0 {
+		flags[1] = 1
+	}
+	h := &header{
+		version:     version,
+		comments:    "Picocrypt repository",
+		flags:       flags,
+		salt:        make([]byte, 16),
+		hkdfSalt:    make([]byte, 32),
+		serpentSalt: make([]byte, 16),
+		nonce:       make([]byte, 24),
+		keyfileHash: make([]byte, 32),
+		authTag:     make([]byte, 64),
+		extFlags:    make([]byte, 16),
+		keyfileIDs:  managedKeyfileIDs(keyfiles),
+	}
+	h.extFlags[5] = byte(len(h.keyfileIDs))
+	if keyfileOnly {
+		h.extFlags[9] = 1
+	}
+	h.prepareKeyfileChecks(keyfiles)
+	rand.Read(h.salt)
+	rand.Read(h.hkdfSalt)
+	rand.Read(h.serpentSalt)
+	rand.Read(h.nonce)
+
+	if _, err := createKey(h, password, keyfiles); err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	writeHeader(&data, h)
+	return os.WriteFile(filepath.Join(path, "config"), data.Bytes(), 0644)
+}
+
+// Unlock a repository with a password and keyfiles
+func openRepository(path string, password string, keyfiles []string) (*repository, error) {
+	fin, err := os.Open(filepath.Join(path, "config"))
+	if err != nil {
+		return nil, errors.New("not a repository")
+	}
+	h, err := readHeader(fin)
+	fin.Close()
+	if err != nil {
+		return nil, errors.New("the repository configuration is damaged")
+	}
+
+	// Check the password and keyfiles the same way as openVolume
+	key, err := unlockKey(h, password, keyfiles)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive all subkeys with HKDF-SHA3
+	r := &repository{path: path, paranoid: h.flags[0] == 1}
+	subkeys := hkdf.New(sha3.New256, key, h.hkdfSalt, nil)
+	r.idKey = make([]byte, 32)
+	subkeys.Read(r.idKey)
+	r.key = make([]byte, 32)
+	subkeys.Read(r.key)
+	r.macKey = make([]byte, 32)
+	subkeys.Read(r.macKey)
+	serpentKey := make([]byte, 32)
+	subkeys.Read(serpentKey)
+	r.serpent, _ = serpent.NewCipher(serpentKey)
+	gear := make([]byte, 256*8)
+	subkeys.Read(gear)
+	for i := range r.gear {
+		r.gear[i] = binary.LittleEndian.Uint64(gear[i*8:])
+	}
+	return r, nil
+}
+
+// Create the MAC used for chunks and snapshots
+func (r *repository) mac() hash.Hash {
+	if r.paranoid {
+		return hmac.New(sha3.New512, r.macKey)
+	}
+	mac, _ := blake2b.New512(r.macKey)
+	return mac
+}
+
+// Encrypt and authenticate data with a random nonce (and IV in paranoid mode)
+func (r *repository) seal(data []byte) []byte {
+	blob := make([]byte, 40, 40+len(data)+64)
+	rand.Read(blob[:40])
+	blob = append(blob, data...)
+	r.xor(blob[:40], blob[40:])
+	mac := r.mac()
+	mac.Write(blob)
+	return mac.Sum(blob)
+}
+
+// Verify and decrypt data encrypted by seal
+func (r *repository) open(blob []byte) ([]byte, error) {
+	if len(blob) < 40+64 {
+		return nil, errors.New("data is truncated")
+	}
+	mac := r.mac()
+	mac.Write(blob[:len(blob)-64])
+	if subtle.ConstantTimeCompare(mac.Sum(nil), blob[len(blob)-64:]) == 0 {
+		return nil, errors.New("data is damaged or modified")
+	}
+	data := append([]byte{}, blob[40:len(blob)-64]...)
+	r.xor(blob[:40], data)
+	return data, nil
+}
+
+// Apply the keystream given by a 24-byte nonce and 16-byte Serpent IV
+func (r *repository) xor(values []byte, data []byte) {
+	chacha, _ := chacha20.NewUnauthenticatedCipher(r.key, values[:24])
+	chacha.XORKeyStream(data, data)
+	if r.paranoid {
+		cipher.NewCTR(r.serpent, values[24:40]).XORKeyStream(data, data)
+	}
+}
+
+// The name of a chunk, a keyed hash of its contents
+func (r *repository) chunkID(data []byte) string {
+	hash, _ := blake2b.New256(r.idKey)
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Where a chunk is stored
+func (r *repository) chunkPath(id string) string {
+	return filepath.Join(r.path, "chunks", id[:2], id)
+}
+
+// Split data into chunks where the rolling hash of the last 64 bytes matches
+// the mask, so boundaries only depend on nearby content
+func (r *repository) split(fin io.Reader, chunk func([]byte) error) error {
+	reader := bufio.NewReaderSize(fin, MiB)
+	data := make([]byte, 0, maxChunk)
+	var hash uint64
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		data = append(data, b)
+		hash = hash<<1 + r.gear[b]
+		if len(data) >= maxChunk || (len(data) >= minChunk && hash&chunkMask == 0) {
+			if err := chunk(data); err != nil {
+				return err
+			}
+			data, hash = data[:0], 0
+		}
+	}
+	if len(data) > 0 {
+		return chunk(data)
+	}
+	return nil
+}
+
+// Write a file atomically, so an interrupted backup never leaves a partial one
+func writeAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%x.tmp", path, time.Now().UnixNano())
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Lock the repository for a backup or for pruning. Backups can run at the
+// same time, but not while pruning, since a backup can reuse a chunk that is
+// about to be deleted. Both take their own lock before looking for the other's,
+// so at least one of them sees the other. Returns how to unlock it.
+func (r *repository) lock(prune bool) (func(), error) {
+	folder := filepath.Join(r.path, "locks")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	name := "prune"
+	if !prune {
+		random := make([]byte, 8)
+		rand.Read(random)
+		name = fmt.Sprintf("backup-%x", random)
+	}
+	pruning := func(path string) error {
+		return fmt.Errorf("the repository is being pruned (delete %s if it isn't)", path)
+	}
+
+	path := filepath.Join(folder, name)
+	fout, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, pruning(path)
+	} else if err != nil {
+		return nil, err
+	}
+	fout.Close()
+	unlock := func() {
+		os.Remove(path)
+	}
+
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	for _, i := range entries {
+		other := filepath.Join(folder, i.Name())
+		if prune && strings.HasPrefix(i.Name(), "backup-") {
+			unlock()
+			return nil, fmt.Errorf("a backup is in progress (delete %s if it isn't)", other)
+		}
+		if !prune && i.Name() == "prune" {
+			unlock()
+			return nil, pruning(other)
+		}
+	}
+	return unlock, nil
+}
+
+// Back up files and folders as a new snapshot, only storing new chunks.
+// Returns the ID of the snapshot and how many bytes of new chunks were stored.
+func (r *repository) backup(inputs []string) (string, int64, error) {
+	unlock, err := r.lock(false)
+	if err != nil {
+		return "", 0, err
+	}
+	defer unlock()
+
+	index := snapshotIndex{Time: time.Now()}
+	var added int64
+	for _, input := range inputs {
+		input = filepath.Clean(input)
+		err := filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			name, _ := filepath.Rel(filepath.Dir(input), path)
+			file := snapshotFile{
+				Name:     filepath.ToSlash(name),
+				Mode:     info.Mode().Perm(),
+				Modified: info.ModTime(),
+				Size:     info.Size(),
+			}
+
+			fin, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer fin.Close()
+			err = r.split(fin, func(data []byte) error {
+				id := r.chunkID(data)
+				file.Chunks = append(file.Chunks, id)
+				if _, err := os.Stat(r.chunkPath(id)); err == nil {
+					return nil
+				}
+				blob := r.seal(data)
+				added += int64(len(blob))
+				return writeAtomic(r.chunkPath(id), blob)
+			})
+			index.Files = append(index.Files, file)
+			return err
+		})
+		if err != nil {
+			return "", added, err
+		}
+	}
+
+	// Snapshots are named by their time, so they sort chronologically
+	data, _ := json.Marshal(index)
+	random := make([]byte, 4)
+	rand.Read(random)
+	id := fmt.Sprintf("%s-%x", index.Time.UTC().Format("20060102T150405.000000000"), random)
+	return id, added, writeAtomic(filepath.Join(r.path, "snapshots", id), r.seal(data))
+}
+
+// List the IDs of all snapshots, oldest first
+func (r *repository) snapshots() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.path, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, i := range entries {
+		if !strings.HasSuffix(i.Name(), ".tmp") {
+			ids = append(ids, i.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Read and decrypt a snapshot
+func (r *repository) snapshot(id string) (*snapshotIndex, error) {
+	if strings.ContainsAny(id, `/\`) || id == "" || id[0] == '.' {
+		return nil, fmt.Errorf("%s: no such snapshot", id)
+	}
+	blob, err := os.ReadFile(filepath.Join(r.path, "snapshots", id))
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such snapshot", id)
+	}
+	data, err := r.open(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	var index snapshotIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	return &index, nil
+}
+
+// Restore the files of a snapshot into a folder, either everything or only
+// the given files and folders
+func (r *repository) restore(id string, folder string, paths []string) error {
+	index, err := r.snapshot(id)
+	if err != nil {
+		return err
+	}
+	found := make([]bool, len(paths))
+	for _, file := range index.Files {
+		wanted := len(paths) == 0
+		for i, want := range paths {
+			want = strings.TrimSuffix(filepath.ToSlash(want), "/")
+			if file.Name == want || strings.HasPrefix(file.Name, want+"/") {
+				wanted, found[i] = true, true
+			}
+		}
+		if !wanted {
+			continue
+		}
+		if !safeName(file.Name) {
+			return fmt.Errorf("%s: unsafe path", file.Name)
+		}
+		if err := r.restoreFile(file, filepath.Join(folder, filepath.FromSlash(file.Name))); err != nil {
+			return err
+		}
+	}
+	for i, ok := range found {
+		if !ok {
+			return fmt.Errorf("%s: no such file in the snapshot", paths[i])
+		}
+	}
+	return nil
+}
+
+// Restore a single file, verifying every chunk
+func (r *repository) restoreFile(file snapshotFile, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fout, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode|0200)
+	if err != nil {
+		return err
+	}
+	for _, id := range file.Chunks {
+		err = func() error {
+			blob, err := os.ReadFile(r.chunkPath(id))
+			if err != nil {
+				return fmt.Errorf("%s: chunk %s is missing", file.Name, id)
+			}
+			data, err := r.open(blob)
+			if err != nil || r.chunkID(data) != id {
+				return fmt.Errorf("%s: chunk %s is damaged or modified", file.Name, id)
+			}
+			_, err = fout.Write(data)
+			return err
+		}()
+		if err != nil {
+			fout.Close()
+			os.Remove(path)
+			return err
+		}
+	}
+	if err := fout.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, file.Modified, file.Modified)
+}
+
+// Delete snapshots, then delete the chunks no remaining snapshot uses.
+// Returns how many snapshots and chunks were deleted.
+func (r *repository) prune(forget []string) (int, int, error) {
+	unlock, err := r.lock(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	// A snapshot can be given more than once, like by ID and by -keep
+	forgotten := map[string]bool{}
+	for _, id := range forget {
+		if forgotten[id] {
+			continue
+		}
+		if _, err := r.snapshot(id); err != nil {
+			return len(forgotten), 0, err
+		}
+		if err := os.Remove(filepath.Join(r.path, "snapshots", id)); err != nil {
+			return len(forgotten), 0, err
+		}
+		forgotten[id] = true
+	}
+
+	// Every snapshot has to be readable, otherwise chunks still in use
+	// could be deleted
+	used := map[string]bool{}
+	ids, err := r.snapshots()
+	if err != nil {
+		return len(forgotten), 0, err
+	}
+	for _, id := range ids {
+		index, err := r.snapshot(id)
+		if err != nil {
+			return len(forgotten), 0, err
+		}
+		for _, file := range index.Files {
+			for _, chunk := range file.Chunks {
+				used[chunk] = true
+			}
+		}
+	}
+
+	deleted := 0
+	err = filepath.Walk(filepath.Join(r.path, "chunks"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || used[info.Name()] {
+			return err
+		}
+		deleted++
+		return os.Remove(path)
+	})
+	return len(forgotten), deleted, err
+}
+
+// Run a command on an unlocked repository
+func repositoryCommand(r *repository, name string, args []string, output string, keep int, fail func(error) int) int {
+	switch name {
+	case "backup":
+		id, added, err := r.backup(args)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("%s  %s added\n", id, sizeify(added))
+	case "restore":
+		if err := r.restore(args[0], output, args[1:]); err != nil {
+			return fail(err)
+		}
+	case "snapshots":
+		ids, err := r.snapshots()
+		if err != nil {
+			return fail(err)
+		}
+		for _, id := range ids {
+			index, err := r.snapshot(id)
+			if err != nil {
+				return fail(err)
+			}
+			var total int64
+			for _, file := range index.Files {
+				total += file.Size
+			}
+			fmt.Printf("%s  %s  %d files  %s\n", id, index.Time.Format("2006-01-02 15:04"), len(index.Files), sizeify(total))
+		}
+	case "prune":
+		forget := args
+		if keep >= 0 {
+			ids, err := r.snapshots()
+			if err != nil {
+				return fail(err)
+			}
+			if len(ids) > keep {
+				forget = append(forget, ids[:len(ids)-keep]...)
+			}
+		}
+		forgotten, deleted, err := r.prune(forget)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("%d snapshots and %d chunks deleted\n", forgotten, deleted)
+	}
+	return 0
+}
@@ -0,0 +1,269 @@
+package main
+
+/*
+
+Threshold keyfiles with Shamir's secret sharing. A random 32-byte key is split
+into n shares so that any k of them can rebuild it, but fewer than k reveal
+nothing about it. Every byte of the key is the constant term of a random
+polynomial of degree k-1 over GF(2^8), and share x holds the value of every
+polynomial at x. Shares are given like keyfiles: the shares of a key are
+combined first, and the key then counts as a single keyfile in the place of
+the first of its shares. See Internals.md for the format.
+
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/HACKERALERT/crypto/sha3"
+)
+
+// Identifies a share
+const shareMagic = "Picocrypt share\n"
+
+// A share as stored on disk
+type keyShare struct {
+	Group     []byte `json:"group"`     // Identifies the key, 16 bytes
+	Threshold int    `json:"threshold"` // Shares needed to rebuild the key
+	Count     int    `json:"count"`     // Shares the key was split into
+	Index     int    `json:"index"`     // Where the polynomials were evaluated
+	Share     []byte `json:"share"`     // Values of the polynomials, 32 bytes
+}
+
+// Not enough shares of a key were given
+type shareError struct {
+	given     int
+	threshold int
+}
+
+func (e *shareError) Error() string {
+	return fmt.Sprintf("not enough shares (%d of %d needed)", e.given, e.threshold)
+}
+
+// Exponentials and logarithms in GF(2^8) with the AES polynomial, so
+// multiplication and division become table lookups
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		// Multiply by the generator 3
+		y := x << 1
+		if y&0x100 != 0 {
+			y ^= 0x11b
+		}
+		x ^= y
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// The ID of a key split into shares, used to check that it was rebuilt correctly
+func shareGroup(key []byte) []byte {
+	sum := sha3.Sum256(append([]byte("Picocrypt shares"), key...))
+	return sum[:16]
+}
+
+// Split a key into shares, any threshold of which can rebuild it
+func splitKey(key []byte, threshold int, count int) ([]*keyShare, error) {
+	if threshold < 2 || threshold > count || count > 255 {
+		return nil, errors.New("invalid number of shares")
+	}
+	group := shareGroup(key)
+	var shares []*keyShare
+	for x := 1; x <= count; x++ {
+		shares = append(shares, &keyShare{group, threshold, count, x, make([]byte, len(key))})
+	}
+
+	coefficients := make([]byte, threshold)
+	for i, secret := range key {
+		coefficients[0] = secret
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, s := range shares {
+			// Evaluate the polynomial with Horner's method
+			y := byte(0)
+			for j := threshold - 1; j >= 0; j-- {
+				y = gfMul(y, byte(s.Index)) ^ coefficients[j]
+			}
+			s.Share[i] = y
+		}
+	}
+	return shares, nil
+}
+
+// Rebuild a key from enough shares with different indices
+func combineKey(shares []*keyShare) ([]byte, error) {
+	key := make([]byte, len(shares[0].Share))
+	for i := range key {
+		// Lagrange interpolation at zero
+		for j, s := range shares {
+			y := s.Share[i]
+			for k, t := range shares {
+				if k != j {
+					y = gfMul(y, gfDiv(byte(t.Index), byte(t.Index)^byte(s.Index)))
+				}
+			}
+			key[i] ^= y
+		}
+	}
+	if !bytes.Equal(shareGroup(key), shares[0].Group) {
+		return nil, errors.New("shares don't match")
+	}
+	return key, nil
+}
+
+// Save shares next to each other, as base-1, base-2, and so on
+func writeShares(base string, shares []*keyShare) ([]string, error) {
+	var paths []string
+	for _, s := range shares {
+		path := fmt.Sprintf("%s-%d", base, s.Index)
+		data, _ := json.MarshalIndent(s, "", "\t")
+		data = append([]byte(shareMagic), data...)
+		if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// Read a share, returning nil if the file is an ordinary keyfile
+func readShare(path string) (*keyShare, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	magic := make([]byte, len(shareMagic))
+	if _, err := io.ReadFull(fin, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if string(magic) != shareMagic {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(fin, maxManagedKeyfile))
+	if err != nil {
+		return nil, err
+	}
+	s := &keyShare{}
+	if json.Unmarshal(data, s) != nil || len(s.Group) != 16 || len(s.Share) != 32 ||
+		s.Threshold < 2 || s.Threshold > s.Count || s.Count > 255 || s.Index < 1 || s.Index > s.Count {
+		return nil, errors.New("damaged share")
+	}
+	return s, nil
+}
+
+// Read the shares among keyfiles, by path
+func readShares(paths []string) (map[string]*keyShare, error) {
+	shares := map[string]*keyShare{}
+	for _, path := range paths {
+		s, err := readShare(path)
+		if err != nil {
+			return nil, &keyfileError{path, err}
+		}
+		if s != nil {
+			shares[path] = s
+		}
+	}
+	return shares, nil
+}
+
+// Combine the shares among keyfiles into their keys. The key is returned for
+// the first share of every key, and nil for the rest of its shares.
+func combineShares(paths []string) (map[string][]byte, error) {
+	shares, err := readShares(paths)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{}
+	for _, path := range paths {
+		first, ok := shares[path]
+		if !ok {
+			continue
+		}
+		if _, done := keys[path]; done {
+			continue
+		}
+
+		// Gather the other shares of the same key, skipping duplicates
+		var group []*keyShare
+		seen := map[int]bool{}
+		for _, other := range paths {
+			s, ok := shares[other]
+			if !ok || !bytes.Equal(s.Group, first.Group) {
+				continue
+			}
+			keys[other] = nil
+			if !seen[s.Index] {
+				seen[s.Index] = true
+				group = append(group, s)
+			}
+		}
+		if len(group) < first.Threshold {
+			return nil, &shareError{len(group), first.Threshold}
+		}
+		key, err := combineKey(group[:first.Threshold])
+		if err != nil {
+			return nil, &keyfileError{path, err}
+		}
+		keys[path] = key
+	}
+	return keys, nil
+}
+
+// How many keyfiles remain once shares are combined, along with the
+// threshold and count of the first key split into shares
+func shareLayout(paths []string) (int, int, int) {
+	shares, err := readShares(paths)
+	if err != nil {
+		return len(paths), 0, 0
+	}
+	remaining, threshold, count := 0, 0, 0
+	var groups [][]byte
+	for _, path := range paths {
+		s, ok := shares[path]
+		if !ok {
+			remaining++
+			continue
+		}
+		if threshold == 0 {
+			threshold, count = s.Threshold, s.Count
+		}
+		known := false
+		for _, i := range groups {
+			known = known || bytes.Equal(i, s.Group)
+		}
+		if !known {
+			groups = append(groups, s.Group)
+			remaining++
+		}
+	}
+	return remaining, threshold, count
+}
@@ -0,0 +1,10 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// The ioctls that get and set the terminal's settings
+const ioctlGetTermios = unix.TIOCGETA
+const ioctlSetTermios = unix.TIOCSETA
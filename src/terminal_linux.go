@@ -0,0 +1,7 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// The ioctls that get and set the terminal's settings
+const ioctlGetTermios = unix.TCGETS
+const ioctlSetTermios = unix.TCSETS
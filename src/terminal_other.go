@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Typed passwords can't be hidden on this platform
+func hideInput(f *os.File) (func(), error) {
+	return nil, errors.New("hiding input isn't supported on this platform")
+}
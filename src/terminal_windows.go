@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Stop the console from showing what's typed, returning how to restore it
+func hideInput(f *os.File) (func(), error) {
+	handle := windows.Handle(f.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return nil, err
+	}
+	hidden := mode&^windows.ENABLE_ECHO_INPUT | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT
+	if err := windows.SetConsoleMode(handle, hidden); err != nil {
+		return nil, err
+	}
+	return func() {
+		windows.SetConsoleMode(handle, mode)
+	}, nil
+}